@@ -4,12 +4,22 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"proxygate/internal/app"
 )
 
 func main() {
-	if err := app.Run(context.Background(), os.Args[1:]); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(app.Check(context.Background(), os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// SIGINT and SIGTERM start a graceful shutdown that drains open tunnels.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.Run(ctx, os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -7,6 +7,7 @@ toolchain go1.23.3
 require (
 	github.com/elazarl/goproxy v1.7.2
 	golang.org/x/net v0.37.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/text v0.23.0 // indirect
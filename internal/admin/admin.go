@@ -0,0 +1,360 @@
+// Package admin serves a token-protected JSON API for inspecting and
+// controlling the proxy pools at runtime, on a listener separate from the proxy.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"proxygate/internal/proxy"
+	"proxygate/internal/source"
+)
+
+const maxRequestBody = 1 << 20
+
+// Drainer stops the proxy from accepting new requests while existing ones finish.
+type Drainer interface {
+	Drain()
+}
+
+// Options configures the admin API.
+type Options struct {
+	ListenAddr string
+	// Token must be presented as "Authorization: Bearer <token>" on every request.
+	Token string
+	Pools *proxy.Registry
+	// Reloaders maps pool names to the reloaders feeding them.
+	Reloaders map[string]*source.Reloader
+	Drainer   Drainer
+}
+
+// Server is the admin HTTP API.
+type Server struct {
+	opts       Options
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+// New creates the admin API. A token is mandatory.
+func New(opts Options) (*Server, error) {
+	if opts.Token == "" {
+		return nil, errors.New("admin API requires a token")
+	}
+	if opts.Pools == nil {
+		return nil, errors.New("admin API requires a pool registry")
+	}
+
+	s := &Server{opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /pools", s.listPools)
+	s.mux.HandleFunc("GET /pools/{pool}/proxies", s.listProxies)
+	s.mux.HandleFunc("POST /pools/{pool}/proxies", s.addProxy)
+	s.mux.HandleFunc("DELETE /pools/{pool}/proxies", s.removeProxy)
+	s.mux.HandleFunc("POST /pools/{pool}/proxies/disable", s.setDisabled(true))
+	s.mux.HandleFunc("POST /pools/{pool}/proxies/enable", s.setDisabled(false))
+	s.mux.HandleFunc("GET /pools/{pool}/sessions", s.listSessions)
+	s.mux.HandleFunc("DELETE /pools/{pool}/sessions", s.deleteSessions)
+	s.mux.HandleFunc("POST /pools/{pool}/reload", s.reloadPool)
+	s.mux.HandleFunc("POST /reload", s.reloadAll)
+	s.mux.HandleFunc("POST /drain", s.drain)
+	s.httpServer = &http.Server{Addr: opts.ListenAddr, Handler: s}
+	return s, nil
+}
+
+// ListenAndServe starts the admin listener. It returns nil once Shutdown has been called.
+func (s *Server) ListenAndServe() error {
+	log.Printf("Starting admin API on %s", s.opts.ListenAddr)
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown closes the listener and waits for in-flight requests until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// ServeHTTP checks the bearer token before dispatching the request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="proxygate-admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+		return
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+func (s *Server) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) == 1
+}
+
+type poolView struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	Proxies int    `json:"proxies"`
+}
+
+func (s *Server) listPools(w http.ResponseWriter, _ *http.Request) {
+	names := s.opts.Pools.Names()
+	views := make([]poolView, 0, len(names))
+	for _, name := range names {
+		pool, err := s.opts.Pools.Get(name)
+		if err != nil {
+			continue
+		}
+		views = append(views, poolView{Name: name, Default: name == s.opts.Pools.DefaultName(), Proxies: pool.Len()})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// proxyView never includes the upstream password.
+type proxyView struct {
+	Key         string            `json:"key"`
+	Protocol    string            `json:"protocol"`
+	Address     string            `json:"address"`
+	Username    string            `json:"username,omitempty"`
+	Weight      int               `json:"weight,omitempty"`
+	MaxConns    int               `json:"max_conns,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Healthy     bool              `json:"healthy"`
+	Disabled    bool              `json:"disabled"`
+	Circuit     string            `json:"circuit"`
+	ActiveConns int               `json:"active_conns"`
+	LatencyMS   float64           `json:"latency_ms"`
+}
+
+func newProxyView(stats proxy.Stats) proxyView {
+	view := proxyView{
+		Key:         stats.Proxy.Key(),
+		Protocol:    stats.Proxy.Protocol,
+		Address:     stats.Proxy.Address,
+		Weight:      stats.Proxy.Weight,
+		MaxConns:    stats.Proxy.MaxConns,
+		Tags:        stats.Proxy.Tags,
+		Healthy:     stats.Healthy,
+		Disabled:    stats.Disabled,
+		Circuit:     stats.Circuit,
+		ActiveConns: stats.ActiveConns,
+		LatencyMS:   milliseconds(stats.Latency),
+	}
+	if stats.Proxy.Credentials != nil {
+		view.Username = stats.Proxy.Credentials.Username
+	}
+	return view
+}
+
+func (s *Server) listProxies(w http.ResponseWriter, req *http.Request) {
+	pool, ok := s.pool(w, req)
+	if !ok {
+		return
+	}
+
+	stats := pool.Stats()
+	views := make([]proxyView, 0, len(stats))
+	for _, entry := range stats {
+		views = append(views, newProxyView(entry))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+type addRequest struct {
+	// Proxy is a single entry in proxy list text syntax.
+	Proxy string `json:"proxy"`
+}
+
+func (s *Server) addProxy(w http.ResponseWriter, req *http.Request) {
+	pool, ok := s.pool(w, req)
+	if !ok {
+		return
+	}
+
+	var body addRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxRequestBody)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if strings.ContainsAny(body.Proxy, "\r\n") {
+		writeError(w, http.StatusBadRequest, errors.New("proxy must be a single entry"))
+		return
+	}
+
+	parsed, err := proxy.Parse(strings.NewReader(body.Proxy), pool.DefaultCredentials())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	upstream := parsed[0]
+	if err := pool.Add(upstream); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	log.Printf("Admin added proxy %s to pool %s", upstream.Key(), req.PathValue("pool"))
+	writeJSON(w, http.StatusCreated, newProxyView(proxy.Stats{Proxy: upstream, Healthy: true, Circuit: "closed"}))
+}
+
+func (s *Server) removeProxy(w http.ResponseWriter, req *http.Request) {
+	pool, ok := s.pool(w, req)
+	if !ok {
+		return
+	}
+	key, ok := proxyKey(w, req)
+	if !ok {
+		return
+	}
+
+	if !pool.Remove(key) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("proxy %s not found", key))
+		return
+	}
+	log.Printf("Admin removed proxy %s from pool %s", key, req.PathValue("pool"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		pool, ok := s.pool(w, req)
+		if !ok {
+			return
+		}
+		key, ok := proxyKey(w, req)
+		if !ok {
+			return
+		}
+
+		if !pool.SetDisabled(key, disabled) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("proxy %s not found", key))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type sessionView struct {
+	Key      string    `json:"key"`
+	Proxy    string    `json:"proxy"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, req *http.Request) {
+	pool, ok := s.pool(w, req)
+	if !ok {
+		return
+	}
+
+	sessions := pool.Sessions()
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{
+			Key:      session.Key,
+			Proxy:    session.Proxy.Key(),
+			Created:  session.Created,
+			LastUsed: session.LastUsed,
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// deleteSessions removes the session named by ?key=, or every session when no key is given.
+func (s *Server) deleteSessions(w http.ResponseWriter, req *http.Request) {
+	pool, ok := s.pool(w, req)
+	if !ok {
+		return
+	}
+
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		removed := pool.ClearSessions()
+		writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+		return
+	}
+	if !pool.DeleteSession(key) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("session %q not found", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": 1})
+}
+
+func (s *Server) reloadPool(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("pool")
+	reloader, ok := s.opts.Reloaders[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+		return
+	}
+
+	if err := reloader.Reload(req.Context(), true); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reloadAll(w http.ResponseWriter, req *http.Request) {
+	failed := make(map[string]string)
+	for name, reloader := range s.opts.Reloaders {
+		if err := reloader.Reload(req.Context(), true); err != nil {
+			failed[name] = err.Error()
+		}
+	}
+
+	if len(failed) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"errors": failed})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) drain(w http.ResponseWriter, _ *http.Request) {
+	if s.opts.Drainer == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("draining is not available"))
+		return
+	}
+	s.opts.Drainer.Drain()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// pool resolves the {pool} path value, writing 404 when it is unknown.
+func (s *Server) pool(w http.ResponseWriter, req *http.Request) (*proxy.Pool, bool) {
+	pool, err := s.opts.Pools.Get(req.PathValue("pool"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	return pool, true
+}
+
+// proxyKey reads the ?key= parameter naming an upstream, e.g. "http://user@10.0.0.1:8080".
+func proxyKey(w http.ResponseWriter, req *http.Request) (string, bool) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key parameter"))
+		return "", false
+	}
+	return key, true
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Admin API response failed: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
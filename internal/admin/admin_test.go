@@ -0,0 +1,199 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+	"proxygate/internal/source"
+)
+
+const testToken = "admin-secret"
+
+type fakeDrainer struct{ drained bool }
+
+func (d *fakeDrainer) Drain() { d.drained = true }
+
+func newTestServer(t *testing.T) (*Server, *proxy.Pool, *fakeDrainer) {
+	t.Helper()
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{
+		{Protocol: "http", Address: "10.0.0.1:8080", Credentials: &auth.Credentials{Username: "user", Password: "hunter2"}},
+		{Protocol: "socks5", Address: "10.0.0.2:1080"},
+	})
+	registry := proxy.NewRegistry()
+	if err := registry.Add("default", pool); err != nil {
+		t.Fatalf("add pool: %v", err)
+	}
+
+	listPath := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(listPath, []byte("10.0.0.3:8080\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+
+	drainer := &fakeDrainer{}
+	srv, err := New(Options{
+		Token:     testToken,
+		Pools:     registry,
+		Reloaders: map[string]*source.Reloader{"default": source.NewReloader(pool, &source.File{Path: listPath}, 0)},
+		Drainer:   drainer,
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	return srv, pool, drainer
+}
+
+func do(t *testing.T, srv *Server, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewRequiresToken(t *testing.T) {
+	if _, err := New(Options{Pools: proxy.NewRegistry()}); err == nil {
+		t.Fatalf("expected error without token")
+	}
+}
+
+func TestRejectsMissingOrWrongToken(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	for _, header := range []string{"", "Bearer wrong", "Basic " + testToken} {
+		req := httptest.NewRequest(http.MethodGet, "/pools", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %q, got %d", header, rec.Code)
+		}
+	}
+}
+
+func TestListProxiesHidesPasswords(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	rec := do(t, srv, http.MethodGet, "/pools/default/proxies", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatalf("response leaks upstream password: %s", rec.Body.String())
+	}
+
+	var views []proxyView
+	if err := json.Unmarshal(rec.Body.Bytes(), &views); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(views) != 2 || views[0].Key != "http://user@10.0.0.1:8080" || views[0].Username != "user" || !views[0].Healthy {
+		t.Fatalf("unexpected proxies: %+v", views)
+	}
+
+	if rec := do(t, srv, http.MethodGet, "/pools/missing/proxies", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown pool, got %d", rec.Code)
+	}
+}
+
+func TestDisableEnableAddRemove(t *testing.T) {
+	srv, pool, _ := newTestServer(t)
+	key := "socks5://10.0.0.2:1080"
+
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies/disable?key="+key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on disable, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for i := 0; i < 20; i++ {
+		selected, _, err := pool.Select("", nil)
+		if err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+		if selected.Key() == key {
+			t.Fatalf("disabled proxy was selected")
+		}
+	}
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies/enable?key="+key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on enable, got %d", rec.Code)
+	}
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies/disable?key=http://10.9.9.9:1", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown proxy, got %d", rec.Code)
+	}
+
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies", `{"proxy": "10.0.0.4:3128"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 on add, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies", `{"proxy": "10.0.0.4:3128"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 on duplicate add, got %d", rec.Code)
+	}
+	if rec := do(t, srv, http.MethodPost, "/pools/default/proxies", `{"proxy": "ftp://10.0.0.5:21"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 on invalid proxy, got %d", rec.Code)
+	}
+	if pool.Len() != 3 {
+		t.Fatalf("expected 3 proxies after add, got %d", pool.Len())
+	}
+
+	if rec := do(t, srv, http.MethodDelete, "/pools/default/proxies?key=http://10.0.0.4:3128", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on remove, got %d", rec.Code)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("expected 2 proxies after remove, got %d", pool.Len())
+	}
+}
+
+func TestSessions(t *testing.T) {
+	srv, pool, _ := newTestServer(t)
+	for _, key := range []string{"alpha", "beta"} {
+		if _, _, err := pool.Select(key, nil); err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+	}
+
+	rec := do(t, srv, http.MethodGet, "/pools/default/sessions", "")
+	var sessions []sessionView
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+
+	if rec := do(t, srv, http.MethodDelete, "/pools/default/sessions?key=alpha", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 on session delete, got %d", rec.Code)
+	}
+	if rec := do(t, srv, http.MethodDelete, "/pools/default/sessions?key=alpha", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for deleted session, got %d", rec.Code)
+	}
+	if rec := do(t, srv, http.MethodDelete, "/pools/default/sessions", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"removed":1`) {
+		t.Fatalf("expected one session cleared, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(pool.Sessions()) != 0 {
+		t.Fatalf("expected no sessions left")
+	}
+}
+
+func TestReloadAndDrain(t *testing.T) {
+	srv, pool, drainer := newTestServer(t)
+
+	if rec := do(t, srv, http.MethodPost, "/pools/default/reload", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on reload, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if pool.Len() != 1 {
+		t.Fatalf("expected reloaded list with 1 proxy, got %d", pool.Len())
+	}
+	if rec := do(t, srv, http.MethodPost, "/pools/missing/reload", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown pool reload, got %d", rec.Code)
+	}
+
+	if rec := do(t, srv, http.MethodPost, "/drain", ""); rec.Code != http.StatusAccepted || !drainer.drained {
+		t.Fatalf("expected drain to be triggered, got %d", rec.Code)
+	}
+}
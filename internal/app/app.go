@@ -2,48 +2,289 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"os"
+	"time"
 
+	"proxygate/internal/admin"
 	"proxygate/internal/auth"
 	"proxygate/internal/config"
+	"proxygate/internal/dialer"
+	"proxygate/internal/health"
+	"proxygate/internal/metrics"
 	"proxygate/internal/proxy"
+	"proxygate/internal/redact"
 	"proxygate/internal/server"
+	"proxygate/internal/source"
 )
 
 // Run is the main entrypoint used by CLI binaries.
-func Run(_ context.Context, args []string) error {
+func Run(ctx context.Context, args []string) error {
+	// Every log line passes through redaction, whatever package produced it.
+	log.SetOutput(redact.NewWriter(log.Writer()))
+
 	cfg, err := config.Load(args)
 	if err != nil {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	var defaultCred *auth.Credentials
+	var clientCred *auth.Credentials
 	if cfg.RequireAuth {
 		cred := cfg.ServerCredentials
-		defaultCred = &cred
+		clientCred = &cred
 		log.Printf("HTTP proxy authentication enabled for user %s", cred.Username)
 	} else {
 		log.Printf("HTTP proxy authentication disabled")
 	}
 
-	pool, err := proxy.LoadFromFile(cfg.ProxyListPath, proxy.Options{
-		DefaultCredentials: defaultCred,
-	})
+	if cfg.UpstreamCredentials != nil {
+		log.Printf("Default upstream credentials configured for user %s", cfg.UpstreamCredentials.Username)
+	}
+
+	pools := proxy.NewRegistry()
+	reloaders := make(map[string]*source.Reloader, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		pool, reloader, err := startPool(ctx, cfg, pc)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pc.Name, err)
+		}
+		reloaders[pc.Name] = reloader
+		if err := pools.Add(pc.Name, pool); err != nil {
+			return err
+		}
+	}
+	if err := pools.SetDefault(cfg.DefaultPool); err != nil {
+		return err
+	}
+	log.Printf("Default pool is %s", pools.DefaultName())
+
+	accessLog, closeAccessLog, err := openAccessLog(cfg.AccessLog)
 	if err != nil {
-		return fmt.Errorf("load proxies: %w", err)
+		return fmt.Errorf("open access log: %w", err)
 	}
+	defer closeAccessLog()
+
+	recorder := metrics.New()
+	srv := server.New(pools, server.Options{
+		ListenAddr:  cfg.ListenAddr,
+		Verbose:     cfg.Verbose,
+		Credentials: clientCred,
+		Metrics:     recorder,
+		AccessLog:   accessLog,
 
-	log.Printf("Loaded %d proxies from %s", pool.Len(), cfg.ProxyListPath)
+		DialTimeout:      cfg.Timeouts.Dial,
+		HandshakeTimeout: cfg.Timeouts.Handshake,
+		IdleTimeout:      cfg.Timeouts.Idle,
+		RequestTimeout:   cfg.Timeouts.Request,
+		ResponseTimeout:  cfg.Timeouts.Response,
 
-	srv := server.New(pool, server.Options{
-		ListenAddr: cfg.ListenAddr,
-		Verbose:    cfg.Verbose,
+		ShutdownDelay: cfg.ShutdownDelay,
 	})
+	if err := startHealthChecks(ctx, cfg, pools, srv.DialerOptions()); err != nil {
+		return err
+	}
+
+	// Side listeners keep serving while the proxy drains and are shut down after it.
+	var listeners []listener
+
+	if cfg.MetricsListenAddr != "" {
+		metricsServer := metrics.NewServer(cfg.MetricsListenAddr, recorder, pools)
+		listeners = append(listeners, listener{"metrics listener", metricsServer})
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil {
+				log.Printf("Metrics listener stopped: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Admin.ListenAddr != "" {
+		adminServer, err := admin.New(admin.Options{
+			ListenAddr: cfg.Admin.ListenAddr,
+			Token:      cfg.Admin.Token,
+			Pools:      pools,
+			Reloaders:  reloaders,
+			Drainer:    srv,
+		})
+		if err != nil {
+			return fmt.Errorf("configure admin API: %w", err)
+		}
+		listeners = append(listeners, listener{"admin API", adminServer})
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				log.Printf("Admin API stopped: %v", err)
+			}
+		}()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
 
-	if err := srv.ListenAndServe(); err != nil {
-		return fmt.Errorf("start server: %w", err)
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			return fmt.Errorf("start server: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
 	}
 
+	log.Printf("Shutdown requested, draining tunnels for up to %s after %s", cfg.ShutdownTimeout, cfg.ShutdownDelay)
+	// The readiness delay comes before draining, so it does not eat into the drain timeout.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownDelay+cfg.ShutdownTimeout)
+	defer cancel()
+	// Tunnels still open at the deadline are force-closed; that is not a failure.
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("shut down server: %w", err)
+	}
+	for _, l := range listeners {
+		if err := l.server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutting down %s: %v", l.name, err)
+		}
+	}
+	log.Printf("Shutdown complete")
 	return nil
 }
+
+// listener is a server running beside the proxy, such as the metrics endpoint.
+type listener struct {
+	name   string
+	server interface{ Shutdown(context.Context) error }
+}
+
+// openAccessLog returns a JSON logger writing to path, or to stdout for "-".
+// An empty path disables access logging.
+func openAccessLog(path string) (*slog.Logger, func(), error) {
+	var w io.Writer
+	closeFn := func() {}
+	switch path {
+	case "":
+		return nil, closeFn, nil
+	case "-":
+		w = os.Stdout
+	default:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = file
+		closeFn = func() { _ = file.Close() }
+	}
+
+	log.Printf("Writing access log to %s", path)
+	return slog.New(slog.NewJSONHandler(redact.NewWriter(w), nil)), closeFn, nil
+}
+
+// startPool builds a pool, loads its list and starts its background workers.
+func startPool(ctx context.Context, cfg config.Config, pc config.PoolConfig) (*proxy.Pool, *source.Reloader, error) {
+	selector, err := proxy.NewSelector(cfg.Strategy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configure selection: %w", err)
+	}
+
+	pool := proxy.NewPool(proxy.Options{
+		DefaultCredentials: cfg.UpstreamCredentials,
+		Selector:           selector,
+		Sticky: proxy.StickyOptions{
+			IdleTTL:       cfg.Sticky.IdleTTL,
+			MaxTTL:        cfg.Sticky.MaxTTL,
+			MaxSessions:   cfg.Sticky.MaxSessions,
+			SweepInterval: cfg.Sticky.SweepInterval,
+		},
+		Breaker: proxy.BreakerOptions{
+			FailureThreshold: cfg.Breaker.FailureThreshold,
+			ErrorRate:        cfg.Breaker.ErrorRate,
+			Window:           cfg.Breaker.Window,
+			Cooldown:         cfg.Breaker.Cooldown,
+			MaxCooldown:      cfg.Breaker.MaxCooldown,
+			HalfOpenTrials:   cfg.Breaker.HalfOpenTrials,
+		},
+	})
+
+	reloader, err := newReloader(cfg, pc, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := reloader.Reload(ctx, true); err != nil {
+		return nil, nil, fmt.Errorf("load proxies: %w", err)
+	}
+
+	log.Printf("Using %s selection across %d proxies in pool %s", cfg.Strategy, pool.Len(), pc.Name)
+
+	reloader.Start(ctx)
+	go pool.RunStickySweeper(ctx)
+
+	return pool, reloader, nil
+}
+
+// startHealthChecks probes every pool in the background, dialing upstreams with
+// the same options as the proxy server.
+func startHealthChecks(ctx context.Context, cfg config.Config, pools *proxy.Registry, dialerOpts dialer.Options) error {
+	if cfg.Health.Interval <= 0 {
+		return nil
+	}
+
+	for _, name := range pools.Names() {
+		pool, err := pools.Get(name)
+		if err != nil {
+			return err
+		}
+		checker, err := health.New(pool, health.Options{
+			Interval:      cfg.Health.Interval,
+			Timeout:       cfg.Health.Timeout,
+			Mode:          cfg.Health.Mode,
+			Target:        cfg.Health.Target,
+			FailThreshold: cfg.Health.FailThreshold,
+			RiseThreshold: cfg.Health.RiseThreshold,
+			Dialer:        dialerOpts,
+		})
+		if err != nil {
+			return fmt.Errorf("pool %s: configure health checks: %w", name, err)
+		}
+		go checker.Run(ctx)
+	}
+	return nil
+}
+
+// newReloader picks the list source for the pool's location.
+func newReloader(cfg config.Config, pc config.PoolConfig, pool *proxy.Pool) (*source.Reloader, error) {
+	format, err := proxy.ParseFormatName(cfg.ProxyFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if source.IsURL(pc.Location) {
+		cachePath := cfg.Source.CachePath
+		if cachePath != "" && len(cfg.Pools) > 1 {
+			// Keep one fallback file per pool.
+			cachePath += "." + pc.Name
+		}
+		src := listSource(pc.Location, format, cfg.UpstreamCredentials, cfg.Source.Timeout, cachePath)
+		return source.NewReloader(pool, src, cfg.Source.RefreshInterval), nil
+	}
+
+	src := listSource(pc.Location, format, cfg.UpstreamCredentials, 0, "")
+	return source.NewReloader(pool, src, cfg.ReloadInterval), nil
+}
+
+// listSource returns the source for a list file or URL. timeout and cachePath
+// only apply to URLs.
+func listSource(location string, format proxy.Format, defaultCred *auth.Credentials, timeout time.Duration, cachePath string) source.Source {
+	if source.IsURL(location) {
+		return &source.HTTP{
+			URL:                location,
+			DefaultCredentials: defaultCred,
+			Format:             format,
+			Timeout:            timeout,
+			CachePath:          cachePath,
+		}
+	}
+	return &source.File{
+		Path:               location,
+		DefaultCredentials: defaultCred,
+		Format:             format,
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"proxygate/internal/check"
+	"proxygate/internal/config"
+	"proxygate/internal/proxy"
+	"proxygate/internal/redact"
+)
+
+// Check runs the check subcommand and returns the process exit code:
+// check.ExitOK when every upstream passed, check.ExitFailures when any
+// failed, and check.ExitError when the list could not be checked at all.
+func Check(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	stderr = redact.NewWriter(stderr)
+
+	cfg, err := config.LoadCheck(args)
+	if err != nil {
+		fmt.Fprintf(stderr, "load config: %v\n", err)
+		return check.ExitError
+	}
+
+	// Lists are read the same way as by the server, honoring -proxy-format.
+	format, err := proxy.ParseFormatName(cfg.ProxyFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "load config: %v\n", err)
+		return check.ExitError
+	}
+	proxies, err := listSource(cfg.ProxyListPath, format, cfg.UpstreamCredentials, cfg.Timeout, "").Load(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "load proxies: %v\n", err)
+		return check.ExitError
+	}
+
+	results := check.Run(ctx, proxies, check.Options{
+		Target:      cfg.Target,
+		EchoURL:     cfg.EchoURL,
+		Timeout:     cfg.Timeout,
+		Concurrency: cfg.Concurrency,
+	})
+
+	write := check.WriteTable
+	if cfg.JSON {
+		write = check.WriteJSON
+	}
+	if err := write(stdout, results); err != nil {
+		fmt.Fprintf(stderr, "write results: %v\n", err)
+		return check.ExitError
+	}
+
+	if check.Failed(results) > 0 {
+		return check.ExitFailures
+	}
+	return check.ExitOK
+}
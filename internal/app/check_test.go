@@ -0,0 +1,58 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"proxygate/internal/check"
+)
+
+func TestCheckExitCodes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := listener.Addr().String()
+	_ = listener.Close()
+
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(path, []byte(dead+"\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Check(context.Background(), []string{"-proxy-file", path, "-target", "127.0.0.1:1"}, &stdout, &stderr); code != check.ExitFailures {
+		t.Fatalf("expected exit code %d for failing upstream, got %d (stderr: %s)", check.ExitFailures, code, stderr.String())
+	}
+
+	if code := Check(context.Background(), []string{"-proxy-file", filepath.Join(t.TempDir(), "missing.txt")}, &stdout, &stderr); code != check.ExitError {
+		t.Fatalf("expected exit code %d for missing list, got %d", check.ExitError, code)
+	}
+}
+
+func TestCheckHonorsProxyFormat(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := listener.Addr().String()
+	_ = listener.Close()
+
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	if err := os.WriteFile(path, []byte("protocol,address\nhttp,"+dead+"\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Check(context.Background(), []string{"-proxy-file", path, "-target", "127.0.0.1:1"}, &stdout, &stderr); code != check.ExitError {
+		t.Fatalf("expected a CSV list named .txt to fail as text, got exit code %d", code)
+	}
+	stderr.Reset()
+	if code := Check(context.Background(), []string{"-proxy-file", path, "-proxy-format", "csv", "-target", "127.0.0.1:1"}, &stdout, &stderr); code != check.ExitFailures {
+		t.Fatalf("expected exit code %d with -proxy-format csv, got %d (stderr: %s)", check.ExitFailures, code, stderr.String())
+	}
+}
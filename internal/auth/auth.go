@@ -1,11 +1,21 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+
+	"proxygate/internal/redact"
 )
 
-const proxyAuthorizationHeader = "Proxy-Authorization"
+const (
+	proxyAuthorizationHeader = "Proxy-Authorization"
+	proxyAuthenticateHeader  = "Proxy-Authenticate"
+	basicScheme              = "Basic"
+)
 
 // Credentials represents a username/password pair.
 type Credentials struct {
@@ -13,11 +23,29 @@ type Credentials struct {
 	Password string
 }
 
+// String identifies the credentials by username only, so formatting them
+// with %v, %+v or %s never exposes the password.
+func (c Credentials) String() string {
+	return c.Username + ":" + redact.Mask
+}
+
+// GoString masks the password for %#v.
+func (c Credentials) GoString() string {
+	return fmt.Sprintf("auth.Credentials{Username:%q, Password:%q}", c.Username, redact.Mask)
+}
+
 // IsValid returns true when both username and password are non-empty.
 func (c Credentials) IsValid() bool {
 	return c.Username != "" && c.Password != ""
 }
 
+// Equal reports whether both credentials match, comparing in constant time.
+func (c Credentials) Equal(other Credentials) bool {
+	userMatch := subtle.ConstantTimeCompare([]byte(c.Username), []byte(other.Username))
+	passMatch := subtle.ConstantTimeCompare([]byte(c.Password), []byte(other.Password))
+	return userMatch&passMatch == 1
+}
+
 // BasicHeader returns the value for a Proxy-Authorization header using basic auth.
 func (c Credentials) BasicHeader() string {
 	if !c.IsValid() {
@@ -38,3 +66,133 @@ func SetProxyAuthorization(req *http.Request, cred Credentials) {
 	}
 	req.Header.Set(proxyAuthorizationHeader, cred.BasicHeader())
 }
+
+// ProxyAuthorization extracts basic credentials from the Proxy-Authorization header of the request.
+func ProxyAuthorization(req *http.Request) (Credentials, bool) {
+	if req == nil {
+		return Credentials{}, false
+	}
+	return ParseBasic(req.Header.Get(proxyAuthorizationHeader))
+}
+
+// ParseBasic decodes a "Basic <token>" header value.
+func ParseBasic(value string) (Credentials, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, basicScheme) {
+		return Credentials{}, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return Credentials{}, false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return Credentials{}, false
+	}
+	return Credentials{Username: username, Password: password}, true
+}
+
+// RemoveProxyAuthorization strips the Proxy-Authorization header so it never reaches upstreams.
+func RemoveProxyAuthorization(req *http.Request) {
+	if req == nil {
+		return
+	}
+	req.Header.Del(proxyAuthorizationHeader)
+}
+
+// SetProxyAuthenticate writes a basic auth challenge for the provided realm.
+func SetProxyAuthenticate(header http.Header, realm string) {
+	header.Set(proxyAuthenticateHeader, basicScheme+` realm="`+realm+`"`)
+}
+
+// SessionOption is the username option carrying a sticky session ID. Session
+// IDs such as UUIDs contain dashes, so its value runs until the remaining
+// tokens form key-value options again, or to the end of the username.
+const SessionOption = "session"
+
+// ErrInvalidOptions reports username options that cannot be parsed. The account
+// name returned alongside it is still valid.
+var ErrInvalidOptions = errors.New("invalid username options")
+
+// ParseUsername splits a username carrying routing options, such as
+// "alice-pool-mobile-country-de-session-abc123", into the account name and its key/value options.
+// When base is non-empty the username must be base itself or base followed by
+// "-key-value" pairs; otherwise the first dash-separated token is the account name.
+// Malformed options are reported with an error wrapping ErrInvalidOptions.
+func ParseUsername(username, base string) (string, map[string]string, error) {
+	var rest string
+	switch {
+	case base != "" && username == base:
+		return base, nil, nil
+	case base != "" && strings.HasPrefix(username, base+"-"):
+		rest = strings.TrimPrefix(username, base+"-")
+	case base != "":
+		return "", nil, fmt.Errorf("username does not match account %q", base)
+	default:
+		var found bool
+		base, rest, found = strings.Cut(username, "-")
+		if !found {
+			return base, nil, nil
+		}
+	}
+
+	tokens := strings.Split(rest, "-")
+	options := make(map[string]string, len(tokens)/2)
+	for i := 0; i < len(tokens); i += 2 {
+		key := strings.ToLower(tokens[i])
+		if i+1 == len(tokens) {
+			return base, nil, fmt.Errorf("%w: option %q has no value", ErrInvalidOptions, tokens[i])
+		}
+		value := tokens[i+1]
+		if key == SessionOption {
+			end := sessionEnd(tokens, i+1)
+			value = strings.Join(tokens[i+1:end], "-")
+			i = end - 2
+		}
+		if key == "" || value == "" {
+			return base, nil, fmt.Errorf("%w: empty option in %q", ErrInvalidOptions, rest)
+		}
+		if _, dup := options[key]; dup {
+			return base, nil, fmt.Errorf("%w: option %q given more than once", ErrInvalidOptions, key)
+		}
+		options[key] = value
+	}
+	return base, options, nil
+}
+
+// sessionEnd returns the index just past the session ID starting at tokens[start]:
+// the first later token from which the rest of the username reads as options,
+// or len(tokens).
+func sessionEnd(tokens []string, start int) int {
+	for end := start + 1; end < len(tokens); end++ {
+		if optionPairs(tokens[end:]) {
+			return end
+		}
+	}
+	return len(tokens)
+}
+
+// optionPairs reports whether tokens are key-value pairs with alphabetic keys.
+func optionPairs(tokens []string) bool {
+	if len(tokens)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(tokens); i += 2 {
+		if !isOptionKey(tokens[i]) || tokens[i+1] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func isOptionKey(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, r := range token {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		base     string
+		wantBase string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{name: "plain", username: "alice", base: "alice", wantBase: "alice"},
+		{name: "pool option", username: "alice-pool-mobile", base: "alice", wantBase: "alice", want: map[string]string{"pool": "mobile"}},
+		{name: "keys are lowercased", username: "alice-POOL-mobile", base: "alice", wantBase: "alice", want: map[string]string{"pool": "mobile"}},
+		{name: "dashed account", username: "team-a-pool-dc", base: "team-a", wantBase: "team-a", want: map[string]string{"pool": "dc"}},
+		{name: "other account", username: "bob-pool-mobile", base: "alice", wantErr: true},
+		{name: "dangling key", username: "alice-pool", base: "alice", wantErr: true},
+		{name: "repeated option", username: "alice-country-de-country-fr", base: "alice", wantErr: true},
+		{name: "no base", username: "bob-pool-mobile", wantBase: "bob", want: map[string]string{"pool": "mobile"}},
+		{name: "dashed session", username: "alice-session-550e8400-e29b", base: "alice", wantBase: "alice", want: map[string]string{"session": "550e8400-e29b"}},
+		{name: "session after options", username: "alice-pool-mobile-session-550e8400-e29b-41d4-a716-446655440000", base: "alice", wantBase: "alice", want: map[string]string{"pool": "mobile", "session": "550e8400-e29b-41d4-a716-446655440000"}},
+		{name: "empty session", username: "alice-session-", base: "alice", wantErr: true},
+		{name: "session before options", username: "alice-session-abc123-pool-mobile-country-de", base: "alice", wantBase: "alice", want: map[string]string{"session": "abc123", "pool": "mobile", "country": "de"}},
+		{name: "dashed session before options", username: "alice-session-550e8400-e29b-41d4-a716-446655440000-country-de", base: "alice", wantBase: "alice", want: map[string]string{"session": "550e8400-e29b-41d4-a716-446655440000", "country": "de"}},
+		{name: "session between options", username: "alice-pool-mobile-session-abc-123-country-de", base: "alice", wantBase: "alice", want: map[string]string{"pool": "mobile", "session": "abc-123", "country": "de"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, options, err := ParseUsername(tt.username, tt.base)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got base %q options %v", base, options)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUsername returned error: %v", err)
+			}
+			if base != tt.wantBase {
+				t.Fatalf("expected base %q, got %q", tt.wantBase, base)
+			}
+			if len(options) != len(tt.want) {
+				t.Fatalf("expected options %v, got %v", tt.want, options)
+			}
+			for key, value := range tt.want {
+				if options[key] != value {
+					t.Fatalf("expected %s=%s, got %v", key, value, options)
+				}
+			}
+		})
+	}
+}
+
+func TestParseUsernameKeepsAccountOnInvalidOptions(t *testing.T) {
+	base, _, err := ParseUsername("alice-pool", "alice")
+	if !errors.Is(err, ErrInvalidOptions) || base != "alice" {
+		t.Fatalf("expected ErrInvalidOptions for account alice, got %q, %v", base, err)
+	}
+	if _, _, err := ParseUsername("bob-pool-mobile", "alice"); errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected an account mismatch, got %v", err)
+	}
+}
+
+func TestCredentialsFormattingHidesPassword(t *testing.T) {
+	cred := Credentials{Username: "user", Password: "hunter2"}
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		for _, value := range []any{cred, &cred} {
+			if out := fmt.Sprintf(format, value); strings.Contains(out, "hunter2") || !strings.Contains(out, "user") {
+				t.Fatalf("Sprintf(%q) = %q", format, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package check probes every upstream of a proxy list through the same dialers
+// the server uses and reports reachability, latency and exit IP.
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"proxygate/internal/dialer"
+	"proxygate/internal/proxy"
+)
+
+// Exit codes of the check subcommand.
+const (
+	ExitOK       = 0
+	ExitFailures = 1
+	ExitError    = 2
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultConcurrency = 16
+	maxEchoBody        = 1 << 10
+)
+
+// Options configures a check run.
+type Options struct {
+	// Target is the host:port each upstream is asked to CONNECT to.
+	Target string
+	// EchoURL, when set, is fetched through each upstream; its body is the exit IP.
+	EchoURL     string
+	Timeout     time.Duration
+	Concurrency int
+	Dialer      dialer.Options
+}
+
+// Result is the outcome of checking a single upstream.
+type Result struct {
+	// Proxy identifies the upstream without its password.
+	Proxy      string        `json:"proxy"`
+	OK         bool          `json:"ok"`
+	Latency    time.Duration `json:"-"`
+	LatencyMS  float64       `json:"latency_ms"`
+	ExitIP     string        `json:"exit_ip,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	ErrorClass string        `json:"error_class,omitempty"`
+}
+
+// Run checks every upstream concurrently and returns results in input order.
+func Run(ctx context.Context, proxies []proxy.Proxy, opts Options) []Result {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultConcurrency
+	}
+
+	results := make([]Result, len(proxies))
+	slots := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i, upstream := range proxies {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, upstream proxy.Proxy) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = checkOne(ctx, upstream, opts)
+		}(i, upstream)
+	}
+	wg.Wait()
+	return results
+}
+
+func checkOne(ctx context.Context, upstream proxy.Proxy, opts Options) Result {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	result := Result{Proxy: upstream.Key()}
+	fail := func(err error) Result {
+		result.Error = err.Error()
+		result.ErrorClass = dialer.Class(err)
+		return result
+	}
+
+	d, err := dialer.For(upstream, opts.Dialer)
+	if err != nil {
+		return fail(err)
+	}
+
+	started := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", opts.Target)
+	result.Latency = time.Since(started)
+	result.LatencyMS = float64(result.Latency.Microseconds()) / 1000
+	if err != nil {
+		return fail(err)
+	}
+	_ = conn.Close()
+
+	if opts.EchoURL != "" {
+		ip, err := exitIP(ctx, upstream, opts)
+		if err != nil {
+			return fail(fmt.Errorf("echo: %w", err))
+		}
+		result.ExitIP = ip
+	}
+
+	result.OK = true
+	return result
+}
+
+// exitIP fetches the echo URL through the upstream, as the server forwards plain HTTP.
+func exitIP(ctx context.Context, upstream proxy.Proxy, opts Options) (string, error) {
+	transport, err := dialer.NewTransport(upstream, opts.Dialer)
+	if err != nil {
+		return "", err
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.EchoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxEchoBody))
+	if err != nil {
+		return "", err
+	}
+	return parseEcho(body)
+}
+
+// parseEcho accepts a bare IP or a JSON object with an "ip" or "origin" field.
+func parseEcho(body []byte) (string, error) {
+	value := strings.TrimSpace(string(body))
+	if strings.HasPrefix(value, "{") {
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return "", fmt.Errorf("invalid JSON response: %w", err)
+		}
+		value = ""
+		for _, key := range []string{"ip", "origin"} {
+			if s, ok := fields[key].(string); ok {
+				value = s
+				break
+			}
+		}
+	}
+
+	if net.ParseIP(value) == nil {
+		return "", errors.New("response does not contain an IP address")
+	}
+	return value, nil
+}
+
+// Failed counts the results that did not pass.
+func Failed(results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if !result.OK {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteTable prints results as an aligned table followed by a summary line.
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tSTATUS\tLATENCY\tEXIT IP\tERROR")
+	for _, result := range results {
+		status := "ok"
+		if !result.OK {
+			status = "failed"
+		}
+		latency := "-"
+		if result.Latency > 0 {
+			latency = result.Latency.Round(time.Millisecond).String()
+		}
+		exitIP := result.ExitIP
+		if exitIP == "" {
+			exitIP = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Proxy, status, latency, exitIP, result.Error)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d/%d upstreams ok\n", len(results)-Failed(results), len(results))
+	return err
+}
+
+// WriteJSON prints results as a JSON array.
+func WriteJSON(w io.Writer, results []Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
@@ -0,0 +1,148 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+// newFakeProxy starts an HTTP proxy handling CONNECT and absolute-URI requests.
+func newFakeProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, _ = io.Copy(conn, target)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func TestRunReportsEachUpstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer echo.Close()
+	authRequired := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer authRequired.Close()
+
+	good := newFakeProxy(t)
+	proxies := []proxy.Proxy{
+		{Protocol: "http", Address: good.Listener.Addr().String()},
+		{Protocol: "http", Address: deadAddress(t)},
+		{Protocol: "http", Address: authRequired.Listener.Addr().String()},
+	}
+
+	results := Run(context.Background(), proxies, Options{
+		Target:  target.Listener.Addr().String(),
+		EchoURL: echo.URL,
+		Timeout: 5 * time.Second,
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if !results[0].OK || results[0].ExitIP != "203.0.113.7" || results[0].Latency <= 0 {
+		t.Fatalf("unexpected result for working proxy: %+v", results[0])
+	}
+	if results[1].OK || results[1].ErrorClass != "network" {
+		t.Fatalf("expected network failure for dead proxy, got %+v", results[1])
+	}
+	if results[2].OK || results[2].ErrorClass != "upstream_auth" {
+		t.Fatalf("expected auth failure, got %+v", results[2])
+	}
+	if Failed(results) != 2 {
+		t.Fatalf("expected 2 failures, got %d", Failed(results))
+	}
+
+	var table bytes.Buffer
+	if err := WriteTable(&table, results); err != nil {
+		t.Fatalf("WriteTable returned error: %v", err)
+	}
+	if !strings.Contains(table.String(), "203.0.113.7") || !strings.Contains(table.String(), "1/3 upstreams ok") {
+		t.Fatalf("unexpected table:\n%s", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := WriteJSON(&out, results); err != nil {
+		t.Fatalf("WriteJSON returned error: %v", err)
+	}
+	var decoded []Result
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON output: %v", err)
+	}
+	if len(decoded) != 3 || decoded[0].ExitIP != "203.0.113.7" || decoded[2].ErrorClass != "upstream_auth" {
+		t.Fatalf("unexpected JSON output: %s", out.String())
+	}
+}
+
+func TestParseEcho(t *testing.T) {
+	tests := map[string]string{
+		"198.51.100.1\n":              "198.51.100.1",
+		`{"ip": "2001:db8::1"}`:       "2001:db8::1",
+		`{"origin": "198.51.100.2"}`:  "198.51.100.2",
+		"<html>blocked</html>":        "",
+		`{"address": "198.51.100.3"}`: "",
+	}
+	for body, want := range tests {
+		got, err := parseEcho([]byte(body))
+		if want == "" {
+			if err == nil {
+				t.Fatalf("expected error for %q, got %q", body, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Fatalf("parseEcho(%q) = %q, %v; want %q", body, got, err, want)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"proxygate/internal/auth"
 )
@@ -19,15 +21,153 @@ const (
 	envProxyListen  = "PROXY_LISTEN"
 	envProxyFile    = "PROXY_FILE"
 	envProxyVerbose = "PROXY_VERBOSE"
+
+	envPools       = "PROXY_POOLS"
+	envDefaultPool = "PROXY_DEFAULT_POOL"
+
+	// DefaultPoolName names the pool built from -proxy-file when no -pool is given.
+	DefaultPoolName = "default"
+
+	envUpstreamUser      = "PROXY_UPSTREAM_USER"
+	envUpstreamPass      = "PROXY_UPSTREAM_PASS"
+	envUpstreamReuseAuth = "PROXY_UPSTREAM_REUSE_AUTH"
+
+	envHealthInterval = "PROXY_HEALTH_INTERVAL"
+	envHealthTimeout  = "PROXY_HEALTH_TIMEOUT"
+	envHealthMode     = "PROXY_HEALTH_MODE"
+	envHealthTarget   = "PROXY_HEALTH_TARGET"
+	envHealthFall     = "PROXY_HEALTH_FALL"
+	envHealthRise     = "PROXY_HEALTH_RISE"
+
+	envStrategy       = "PROXY_STRATEGY"
+	envReloadInterval = "PROXY_RELOAD_INTERVAL"
+	envSourceRefresh  = "PROXY_SOURCE_REFRESH"
+	envSourceTimeout  = "PROXY_SOURCE_TIMEOUT"
+	envSourceCache    = "PROXY_SOURCE_CACHE"
+	envProxyFormat    = "PROXY_FORMAT"
+
+	envStickyIdleTTL     = "PROXY_STICKY_IDLE_TTL"
+	envStickyMaxTTL      = "PROXY_STICKY_MAX_TTL"
+	envStickyMaxSessions = "PROXY_STICKY_MAX_SESSIONS"
+	envStickySweep       = "PROXY_STICKY_SWEEP_INTERVAL"
+
+	envBreakerThreshold   = "PROXY_BREAKER_THRESHOLD"
+	envBreakerErrorRate   = "PROXY_BREAKER_ERROR_RATE"
+	envBreakerWindow      = "PROXY_BREAKER_WINDOW"
+	envBreakerCooldown    = "PROXY_BREAKER_COOLDOWN"
+	envBreakerMaxCooldown = "PROXY_BREAKER_MAX_COOLDOWN"
+	envBreakerHalfOpen    = "PROXY_BREAKER_HALF_OPEN"
+
+	envAdminListen = "PROXY_ADMIN_LISTEN"
+	envAdminToken  = "PROXY_ADMIN_TOKEN"
+
+	envMetricsListen = "PROXY_METRICS_LISTEN"
+	envAccessLog     = "PROXY_ACCESS_LOG"
+
+	envShutdownDelay   = "PROXY_SHUTDOWN_DELAY"
+	envShutdownTimeout = "PROXY_SHUTDOWN_TIMEOUT"
+
+	envDialTimeout      = "PROXY_DIAL_TIMEOUT"
+	envHandshakeTimeout = "PROXY_HANDSHAKE_TIMEOUT"
+	envIdleTimeout      = "PROXY_IDLE_TIMEOUT"
+	envRequestTimeout   = "PROXY_REQUEST_TIMEOUT"
+	envResponseTimeout  = "PROXY_RESPONSE_TIMEOUT"
 )
 
 // Config captures runtime configuration for the proxy server.
 type Config struct {
-	ListenAddr        string
-	ProxyListPath     string
+	ListenAddr    string
+	ProxyListPath string
+	// Pools lists the named upstream pools; it always holds at least one entry.
+	Pools          []PoolConfig
+	DefaultPool    string
+	ReloadInterval time.Duration
+	Source         SourceConfig
+	// ProxyFormat forces the list format for every pool; empty detects it by extension.
+	ProxyFormat       string
+	Strategy          string
 	Verbose           bool
 	RequireAuth       bool
 	ServerCredentials auth.Credentials
+	// UpstreamCredentials are applied to upstream proxies without inline credentials.
+	// Nil means such upstreams are used anonymously.
+	UpstreamCredentials *auth.Credentials
+	Sticky              StickyConfig
+	Health              HealthConfig
+	Breaker             BreakerConfig
+	Admin               AdminConfig
+	// MetricsListenAddr serves Prometheus metrics when set.
+	MetricsListenAddr string
+	// AccessLog is the file receiving JSON access-log lines, "-" for stdout, or empty to disable.
+	AccessLog string
+	// ShutdownDelay keeps serving with /readyz failing before draining starts on SIGTERM.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds how long open tunnels may drain after SIGTERM before they are closed.
+	ShutdownTimeout time.Duration
+	Timeouts        TimeoutConfig
+}
+
+// TimeoutConfig bounds each stage of serving a client. A zero timeout is disabled.
+type TimeoutConfig struct {
+	// Dial bounds connecting to an upstream proxy.
+	Dial time.Duration
+	// Handshake bounds opening a tunnel through an upstream, dial included.
+	Handshake time.Duration
+	// Idle closes CONNECT tunnels that carry no traffic for this long.
+	Idle time.Duration
+	// Request bounds a plain HTTP request, or opening a tunnel, across all retries.
+	Request time.Duration
+	// Response bounds the wait for response headers to a plain HTTP request.
+	Response time.Duration
+}
+
+// AdminConfig configures the admin API. An empty ListenAddr disables it.
+type AdminConfig struct {
+	ListenAddr string
+	Token      string
+}
+
+// PoolConfig names a pool and the path or URL its proxy list is loaded from.
+type PoolConfig struct {
+	Name     string
+	Location string
+}
+
+// SourceConfig configures proxy lists fetched from http(s):// URLs.
+type SourceConfig struct {
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+	CachePath       string
+}
+
+// StickyConfig bounds sticky-session memory. Zero values disable the corresponding limit.
+type StickyConfig struct {
+	IdleTTL       time.Duration
+	MaxTTL        time.Duration
+	MaxSessions   int
+	SweepInterval time.Duration
+}
+
+// BreakerConfig configures the passive per-upstream circuit breaker.
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the circuit; zero disables the breaker.
+	FailureThreshold int
+	ErrorRate        float64
+	Window           int
+	Cooldown         time.Duration
+	MaxCooldown      time.Duration
+	HalfOpenTrials   int
+}
+
+// HealthConfig configures active health checking of upstream proxies.
+type HealthConfig struct {
+	// Interval between probe rounds; zero disables health checking.
+	Interval      time.Duration
+	Timeout       time.Duration
+	Mode          string
+	Target        string
+	FailThreshold int
+	RiseThreshold int
 }
 
 // Load parses configuration from command-line flags and environment variables.
@@ -40,20 +180,64 @@ func Load(args []string) (Config, error) {
 	listenDefault := getEnvOrDefault(envProxyListen, defaultListenAddr)
 	proxyFileDefault := getEnvOrDefault(envProxyFile, defaultProxyFile)
 	verboseDefault := getBoolEnvOrDefault(envProxyVerbose, false)
+	reuseAuthDefault := getBoolEnvOrDefault(envUpstreamReuseAuth, false)
 
 	var cfg Config
 	flagSet.StringVar(&cfg.ListenAddr, "listen", listenDefault, "Address for the HTTP proxy server to listen on (env: PROXY_LISTEN)")
-	flagSet.StringVar(&cfg.ProxyListPath, "proxy-file", proxyFileDefault, "Path to the proxy list file (env: PROXY_FILE)")
+	flagSet.StringVar(&cfg.ProxyListPath, "proxy-file", proxyFileDefault, "Path or http(s):// URL of the proxy list (env: PROXY_FILE)")
+	var poolFlags []string
+	flagSet.Func("pool", "Named pool as name=path-or-URL, repeatable; replaces -proxy-file (env: PROXY_POOLS, comma-separated)", func(value string) error {
+		poolFlags = append(poolFlags, value)
+		return nil
+	})
+	flagSet.StringVar(&cfg.DefaultPool, "default-pool", getEnvOrDefault(envDefaultPool, ""), "Pool used when a request does not name one, defaults to the first pool (env: PROXY_DEFAULT_POOL)")
+
+	flagSet.StringVar(&cfg.ProxyFormat, "proxy-format", getEnvOrDefault(envProxyFormat, ""), "Proxy list format: text, json, yaml or csv; detected from the extension when empty (env: PROXY_FORMAT)")
+	flagSet.DurationVar(&cfg.ReloadInterval, "reload-interval", getDurationEnvOrDefault(envReloadInterval, 5*time.Second), "How often the proxy list is checked for changes, 0 disables polling (env: PROXY_RELOAD_INTERVAL)")
+	flagSet.DurationVar(&cfg.Source.RefreshInterval, "source-refresh", getDurationEnvOrDefault(envSourceRefresh, 5*time.Minute), "How often a URL proxy list is re-fetched, 0 disables (env: PROXY_SOURCE_REFRESH)")
+	flagSet.DurationVar(&cfg.Source.Timeout, "source-timeout", getDurationEnvOrDefault(envSourceTimeout, 30*time.Second), "Timeout for fetching a URL proxy list (env: PROXY_SOURCE_TIMEOUT)")
+	flagSet.StringVar(&cfg.Source.CachePath, "source-cache", getEnvOrDefault(envSourceCache, ""), "File keeping the last good URL proxy list as a startup fallback (env: PROXY_SOURCE_CACHE)")
+	flagSet.StringVar(&cfg.Strategy, "strategy", getEnvOrDefault(envStrategy, "random"), "Upstream selection strategy: random, round-robin, weighted, least-conn or latency (env: PROXY_STRATEGY)")
 
 	userFlag := flagSet.String("user", "", "Username for HTTP proxy basic authentication (env: PROXY_USER)")
 	passFlag := flagSet.String("pass", "", "Password for HTTP proxy basic authentication (env: PROXY_PASS)")
+	upstreamUserFlag := flagSet.String("upstream-user", "", "Default username for upstream proxies without inline credentials (env: PROXY_UPSTREAM_USER)")
+	upstreamPassFlag := flagSet.String("upstream-pass", "", "Default password for upstream proxies without inline credentials (env: PROXY_UPSTREAM_PASS)")
+	reuseAuthFlag := flagSet.Bool("upstream-reuse-auth", reuseAuthDefault, "Reuse the -user/-pass credentials for upstream proxies without inline credentials (env: PROXY_UPSTREAM_REUSE_AUTH)")
+	flagSet.DurationVar(&cfg.Sticky.IdleTTL, "sticky-idle-ttl", getDurationEnvOrDefault(envStickyIdleTTL, 30*time.Minute), "Expire sticky sessions unused for this long, 0 disables (env: PROXY_STICKY_IDLE_TTL)")
+	flagSet.DurationVar(&cfg.Sticky.MaxTTL, "sticky-max-ttl", getDurationEnvOrDefault(envStickyMaxTTL, 0), "Expire sticky sessions this long after creation, 0 disables (env: PROXY_STICKY_MAX_TTL)")
+	flagSet.IntVar(&cfg.Sticky.MaxSessions, "sticky-max-sessions", getIntEnvOrDefault(envStickyMaxSessions, 100000), "Maximum sticky sessions kept, least recently used evicted first, 0 disables (env: PROXY_STICKY_MAX_SESSIONS)")
+	flagSet.DurationVar(&cfg.Sticky.SweepInterval, "sticky-sweep-interval", getDurationEnvOrDefault(envStickySweep, time.Minute), "How often expired sticky sessions are purged (env: PROXY_STICKY_SWEEP_INTERVAL)")
+	flagSet.DurationVar(&cfg.Health.Interval, "health-interval", getDurationEnvOrDefault(envHealthInterval, 0), "Interval between upstream health checks, 0 disables (env: PROXY_HEALTH_INTERVAL)")
+	flagSet.DurationVar(&cfg.Health.Timeout, "health-timeout", getDurationEnvOrDefault(envHealthTimeout, 10*time.Second), "Timeout for a single health probe (env: PROXY_HEALTH_TIMEOUT)")
+	flagSet.StringVar(&cfg.Health.Mode, "health-mode", getEnvOrDefault(envHealthMode, "tcp"), "Health probe: tcp, connect or http (env: PROXY_HEALTH_MODE)")
+	flagSet.StringVar(&cfg.Health.Target, "health-target", getEnvOrDefault(envHealthTarget, ""), "host:port for connect probes or URL for http probes (env: PROXY_HEALTH_TARGET)")
+	flagSet.IntVar(&cfg.Health.FailThreshold, "health-fall", getIntEnvOrDefault(envHealthFall, 3), "Consecutive failed probes before an upstream is marked unhealthy (env: PROXY_HEALTH_FALL)")
+	flagSet.IntVar(&cfg.Health.RiseThreshold, "health-rise", getIntEnvOrDefault(envHealthRise, 2), "Consecutive successful probes before an upstream is healthy again (env: PROXY_HEALTH_RISE)")
+	flagSet.IntVar(&cfg.Breaker.FailureThreshold, "breaker-threshold", getIntEnvOrDefault(envBreakerThreshold, 5), "Consecutive upstream failures that open its circuit, 0 disables (env: PROXY_BREAKER_THRESHOLD)")
+	flagSet.Float64Var(&cfg.Breaker.ErrorRate, "breaker-error-rate", getFloatEnvOrDefault(envBreakerErrorRate, 0.5), "Failure ratio over the window that opens the circuit (env: PROXY_BREAKER_ERROR_RATE)")
+	flagSet.IntVar(&cfg.Breaker.Window, "breaker-window", getIntEnvOrDefault(envBreakerWindow, 20), "Number of recent requests used for the error rate (env: PROXY_BREAKER_WINDOW)")
+	flagSet.DurationVar(&cfg.Breaker.Cooldown, "breaker-cooldown", getDurationEnvOrDefault(envBreakerCooldown, 10*time.Second), "Initial open-circuit cooldown, doubled on every re-open (env: PROXY_BREAKER_COOLDOWN)")
+	flagSet.DurationVar(&cfg.Breaker.MaxCooldown, "breaker-max-cooldown", getDurationEnvOrDefault(envBreakerMaxCooldown, 5*time.Minute), "Upper bound for the open-circuit cooldown, 0 for none (env: PROXY_BREAKER_MAX_COOLDOWN)")
+	flagSet.IntVar(&cfg.Breaker.HalfOpenTrials, "breaker-half-open", getIntEnvOrDefault(envBreakerHalfOpen, 1), "Concurrent trial requests allowed in half-open state (env: PROXY_BREAKER_HALF_OPEN)")
+	flagSet.StringVar(&cfg.Admin.ListenAddr, "admin-listen", getEnvOrDefault(envAdminListen, ""), "Address for the admin API, disabled when empty (env: PROXY_ADMIN_LISTEN)")
+	flagSet.StringVar(&cfg.Admin.Token, "admin-token", getEnvOrDefault(envAdminToken, ""), "Bearer token required by the admin API (env: PROXY_ADMIN_TOKEN)")
+	flagSet.StringVar(&cfg.MetricsListenAddr, "metrics-listen", getEnvOrDefault(envMetricsListen, ""), "Address serving Prometheus metrics on /metrics, disabled when empty (env: PROXY_METRICS_LISTEN)")
+	flagSet.StringVar(&cfg.AccessLog, "access-log", getEnvOrDefault(envAccessLog, ""), "File for JSON access-log lines, - for stdout, disabled when empty (env: PROXY_ACCESS_LOG)")
+	flagSet.DurationVar(&cfg.ShutdownDelay, "shutdown-delay", getDurationEnvOrDefault(envShutdownDelay, 5*time.Second), "How long to keep serving with /readyz failing before draining on shutdown (env: PROXY_SHUTDOWN_DELAY)")
+	flagSet.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", getDurationEnvOrDefault(envShutdownTimeout, 30*time.Second), "How long open tunnels may finish on shutdown before they are closed (env: PROXY_SHUTDOWN_TIMEOUT)")
+	flagSet.DurationVar(&cfg.Timeouts.Dial, "dial-timeout", getDurationEnvOrDefault(envDialTimeout, 10*time.Second), "Timeout for connecting to an upstream proxy, 0 disables (env: PROXY_DIAL_TIMEOUT)")
+	flagSet.DurationVar(&cfg.Timeouts.Handshake, "handshake-timeout", getDurationEnvOrDefault(envHandshakeTimeout, 30*time.Second), "Timeout for opening a tunnel through an upstream, dial included, 0 disables (env: PROXY_HANDSHAKE_TIMEOUT)")
+	flagSet.DurationVar(&cfg.Timeouts.Idle, "idle-timeout", getDurationEnvOrDefault(envIdleTimeout, 0), "Close CONNECT tunnels without traffic for this long, 0 disables (env: PROXY_IDLE_TIMEOUT)")
+	flagSet.DurationVar(&cfg.Timeouts.Request, "request-timeout", getDurationEnvOrDefault(envRequestTimeout, 0), "Timeout for a plain HTTP request or for opening a tunnel, retries included, 0 disables (env: PROXY_REQUEST_TIMEOUT)")
+	flagSet.DurationVar(&cfg.Timeouts.Response, "response-timeout", getDurationEnvOrDefault(envResponseTimeout, 0), "Timeout for response headers to a plain HTTP request, blamed on the target, 0 disables (env: PROXY_RESPONSE_TIMEOUT)")
 	flagSet.BoolVar(&cfg.Verbose, "verbose", verboseDefault, "Enable verbose logging for proxy handler (env: PROXY_VERBOSE)")
 
 	if err := flagSet.Parse(args); err != nil {
 		return Config{}, err
 	}
 
-	cred, requireAuth, err := resolveCredentials(*userFlag, *passFlag)
+	cred, requireAuth, err := resolveCredentials(*userFlag, *passFlag, envProxyUser, envProxyPass)
 	if err != nil {
 		return Config{}, err
 	}
@@ -61,23 +245,182 @@ func Load(args []string) (Config, error) {
 	cfg.ServerCredentials = cred
 	cfg.RequireAuth = requireAuth
 
-	if cfg.ProxyListPath == "" {
-		return Config{}, errors.New("proxy list path cannot be empty")
+	upstreamCred, hasUpstreamCred, err := resolveCredentials(*upstreamUserFlag, *upstreamPassFlag, envUpstreamUser, envUpstreamPass)
+	if err != nil {
+		return Config{}, fmt.Errorf("upstream credentials: %w", err)
+	}
+
+	switch {
+	case *reuseAuthFlag && hasUpstreamCred:
+		return Config{}, errors.New("upstream credentials cannot be combined with -upstream-reuse-auth")
+	case *reuseAuthFlag && !requireAuth:
+		return Config{}, errors.New("-upstream-reuse-auth requires -user and -pass")
+	case *reuseAuthFlag:
+		reused := cred
+		cfg.UpstreamCredentials = &reused
+	case hasUpstreamCred:
+		cfg.UpstreamCredentials = &upstreamCred
+	}
+
+	if len(poolFlags) == 0 {
+		if env := strings.TrimSpace(os.Getenv(envPools)); env != "" {
+			poolFlags = strings.Split(env, ",")
+		}
+	}
+
+	if len(poolFlags) == 0 {
+		if cfg.ProxyListPath == "" {
+			return Config{}, errors.New("proxy list path cannot be empty")
+		}
+		cfg.Pools = []PoolConfig{{Name: DefaultPoolName, Location: cfg.ProxyListPath}}
+	} else {
+		pools, err := parsePools(poolFlags)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.Pools = pools
+	}
+
+	if cfg.DefaultPool == "" {
+		cfg.DefaultPool = cfg.Pools[0].Name
+	} else if !hasPool(cfg.Pools, cfg.DefaultPool) {
+		return Config{}, fmt.Errorf("default pool %q is not configured", cfg.DefaultPool)
 	}
 
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = defaultListenAddr
 	}
 
+	if cfg.Breaker.FailureThreshold > 0 && cfg.Breaker.HalfOpenTrials <= 0 {
+		return Config{}, errors.New("-breaker-half-open must be at least 1")
+	}
+
+	if cfg.Admin.ListenAddr != "" && cfg.Admin.Token == "" {
+		return Config{}, errors.New("-admin-listen requires -admin-token")
+	}
+
+	if err := validateProxyFormat(cfg.ProxyFormat); err != nil {
+		return Config{}, err
+	}
+
+	switch cfg.Health.Mode {
+	case "tcp", "connect", "http":
+	default:
+		return Config{}, fmt.Errorf("unknown health check mode %q", cfg.Health.Mode)
+	}
+
 	return cfg, nil
 }
 
-func resolveCredentials(user, pass string) (auth.Credentials, bool, error) {
+// parsePools parses name=location pool definitions.
+func parsePools(values []string) ([]PoolConfig, error) {
+	pools := make([]PoolConfig, 0, len(values))
+	for _, value := range values {
+		name, location, ok := strings.Cut(strings.TrimSpace(value), "=")
+		name = strings.TrimSpace(name)
+		location = strings.TrimSpace(location)
+		if !ok || name == "" || location == "" {
+			return nil, fmt.Errorf("invalid pool %q: expected name=path-or-URL", value)
+		}
+		if strings.ContainsAny(name, "-, ") {
+			return nil, fmt.Errorf("invalid pool name %q: must not contain dashes, commas or spaces", name)
+		}
+		if hasPool(pools, name) {
+			return nil, fmt.Errorf("pool %q is defined more than once", name)
+		}
+		pools = append(pools, PoolConfig{Name: name, Location: location})
+	}
+	return pools, nil
+}
+
+func hasPool(pools []PoolConfig, name string) bool {
+	for _, pool := range pools {
+		if pool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConfig captures configuration for the check subcommand.
+type CheckConfig struct {
+	ProxyListPath string
+	// ProxyFormat forces the list format; empty detects it by extension.
+	ProxyFormat string
+	// Target is the host:port each upstream is asked to CONNECT to.
+	Target string
+	// EchoURL, when set, is fetched through each upstream to learn its exit IP.
+	EchoURL     string
+	Timeout     time.Duration
+	Concurrency int
+	JSON        bool
+	// UpstreamCredentials are applied to upstream proxies without inline credentials.
+	UpstreamCredentials *auth.Credentials
+}
+
+// LoadCheck parses the flags of the check subcommand, using the same
+// environment variables as Load for shared settings.
+func LoadCheck(args []string) (CheckConfig, error) {
+	flagSet := flag.NewFlagSet("proxygate check", flag.ContinueOnError)
+	flagSet.SetOutput(os.Stderr)
+
+	var cfg CheckConfig
+	flagSet.StringVar(&cfg.ProxyListPath, "proxy-file", getEnvOrDefault(envProxyFile, defaultProxyFile), "Path of the proxy list to check (env: PROXY_FILE)")
+	flagSet.StringVar(&cfg.ProxyFormat, "proxy-format", getEnvOrDefault(envProxyFormat, ""), "Proxy list format: text, json, yaml or csv; detected from the extension when empty (env: PROXY_FORMAT)")
+	flagSet.StringVar(&cfg.Target, "target", "example.com:443", "host:port each upstream is asked to CONNECT to")
+	flagSet.StringVar(&cfg.EchoURL, "echo-url", "", "URL returning the caller's IP, fetched through each upstream to report its exit IP")
+	flagSet.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "Timeout for checking a single upstream")
+	flagSet.IntVar(&cfg.Concurrency, "concurrency", 16, "Number of upstreams checked in parallel")
+	flagSet.BoolVar(&cfg.JSON, "json", false, "Print results as JSON instead of a table")
+	upstreamUserFlag := flagSet.String("upstream-user", "", "Default username for upstream proxies without inline credentials (env: PROXY_UPSTREAM_USER)")
+	upstreamPassFlag := flagSet.String("upstream-pass", "", "Default password for upstream proxies without inline credentials (env: PROXY_UPSTREAM_PASS)")
+
+	if err := flagSet.Parse(args); err != nil {
+		return CheckConfig{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return CheckConfig{}, fmt.Errorf("unexpected arguments: %v", flagSet.Args())
+	}
+
+	upstreamCred, hasUpstreamCred, err := resolveCredentials(*upstreamUserFlag, *upstreamPassFlag, envUpstreamUser, envUpstreamPass)
+	if err != nil {
+		return CheckConfig{}, fmt.Errorf("upstream credentials: %w", err)
+	}
+	if hasUpstreamCred {
+		cfg.UpstreamCredentials = &upstreamCred
+	}
+
+	if cfg.ProxyListPath == "" {
+		return CheckConfig{}, errors.New("proxy list path cannot be empty")
+	}
+	if cfg.Target == "" {
+		return CheckConfig{}, errors.New("-target cannot be empty")
+	}
+	if cfg.Concurrency < 1 {
+		return CheckConfig{}, errors.New("-concurrency must be at least 1")
+	}
+	if err := validateProxyFormat(cfg.ProxyFormat); err != nil {
+		return CheckConfig{}, err
+	}
+
+	return cfg, nil
+}
+
+func validateProxyFormat(name string) error {
+	switch strings.ToLower(name) {
+	case "", "auto", "text", "txt", "json", "yaml", "yml", "csv":
+		return nil
+	default:
+		return fmt.Errorf("unknown proxy list format %q", name)
+	}
+}
+
+func resolveCredentials(user, pass, userEnv, passEnv string) (auth.Credentials, bool, error) {
 	if user == "" {
-		user = strings.TrimSpace(os.Getenv(envProxyUser))
+		user = strings.TrimSpace(os.Getenv(userEnv))
 	}
 	if pass == "" {
-		pass = strings.TrimSpace(os.Getenv(envProxyPass))
+		pass = strings.TrimSpace(os.Getenv(passEnv))
 	}
 
 	credentials := auth.Credentials{
@@ -112,3 +455,42 @@ func getBoolEnvOrDefault(key string, defaultValue bool) bool {
 	}
 	return value == "true" || value == "1" || value == "yes" || value == "on"
 }
+
+// getDurationEnvOrDefault returns the duration value of the environment variable if set and valid, otherwise returns the default.
+func getDurationEnvOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return defaultValue
+	}
+	return parsed
+}
+
+// getIntEnvOrDefault returns the integer value of the environment variable if set and valid, otherwise returns the default.
+func getIntEnvOrDefault(key string, defaultValue int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	return parsed
+}
+
+// getFloatEnvOrDefault returns the float value of the environment variable if set and valid, otherwise returns the default.
+func getFloatEnvOrDefault(key string, defaultValue float64) float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return parsed
+}
@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestLoadUsesFlags(t *testing.T) {
 	args := []string{
@@ -155,3 +158,146 @@ func TestGetBoolEnvOrDefault(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadSeparatesUpstreamCredentials(t *testing.T) {
+	t.Setenv("PROXY_UPSTREAM_USER", "")
+	t.Setenv("PROXY_UPSTREAM_PASS", "")
+
+	args := []string{
+		"-user", "alice",
+		"-pass", "secret",
+		"-upstream-user", "carol",
+		"-upstream-pass", "upstream-secret",
+	}
+
+	cfg, err := Load(args)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+
+	if cfg.UpstreamCredentials == nil {
+		t.Fatalf("expected upstream credentials to be set")
+	}
+	if cfg.UpstreamCredentials.Username != "carol" || cfg.UpstreamCredentials.Password != "upstream-secret" {
+		t.Fatalf("unexpected upstream credentials: %+v", cfg.UpstreamCredentials)
+	}
+	if cfg.ServerCredentials.Username != "alice" {
+		t.Fatalf("expected server credentials to stay independent, got %+v", cfg.ServerCredentials)
+	}
+}
+
+func TestLoadDoesNotReuseServerCredentialsByDefault(t *testing.T) {
+	t.Setenv("PROXY_UPSTREAM_USER", "")
+	t.Setenv("PROXY_UPSTREAM_PASS", "")
+	t.Setenv("PROXY_UPSTREAM_REUSE_AUTH", "")
+
+	cfg, err := Load([]string{"-user", "alice", "-pass", "secret"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.UpstreamCredentials != nil {
+		t.Fatalf("expected no upstream credentials, got %+v", cfg.UpstreamCredentials)
+	}
+
+	cfg, err = Load([]string{"-user", "alice", "-pass", "secret", "-upstream-reuse-auth"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.UpstreamCredentials == nil || cfg.UpstreamCredentials.Username != "alice" {
+		t.Fatalf("expected server credentials reused upstream, got %+v", cfg.UpstreamCredentials)
+	}
+
+	if _, err := Load([]string{"-upstream-reuse-auth"}); err == nil {
+		t.Fatalf("expected error when reusing credentials without -user/-pass")
+	}
+}
+
+func TestLoadPools(t *testing.T) {
+	t.Setenv("PROXY_POOLS", "")
+	t.Setenv("PROXY_DEFAULT_POOL", "")
+
+	cfg, err := Load([]string{"-proxy-file", "custom.txt"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if len(cfg.Pools) != 1 || cfg.Pools[0] != (PoolConfig{Name: DefaultPoolName, Location: "custom.txt"}) || cfg.DefaultPool != DefaultPoolName {
+		t.Fatalf("expected single default pool from -proxy-file, got %+v (default %q)", cfg.Pools, cfg.DefaultPool)
+	}
+
+	cfg, err = Load([]string{"-pool", "residential=res.txt", "-pool", "mobile=https://example.com/list", "-default-pool", "mobile"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	want := []PoolConfig{{Name: "residential", Location: "res.txt"}, {Name: "mobile", Location: "https://example.com/list"}}
+	if len(cfg.Pools) != len(want) || cfg.Pools[0] != want[0] || cfg.Pools[1] != want[1] {
+		t.Fatalf("unexpected pools: %+v", cfg.Pools)
+	}
+	if cfg.DefaultPool != "mobile" {
+		t.Fatalf("expected default pool mobile, got %q", cfg.DefaultPool)
+	}
+
+	t.Setenv("PROXY_POOLS", "a=a.txt,b=b.txt")
+	cfg, err = Load(nil)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if len(cfg.Pools) != 2 || cfg.DefaultPool != "a" {
+		t.Fatalf("expected pools from env with first as default, got %+v (default %q)", cfg.Pools, cfg.DefaultPool)
+	}
+
+	for _, args := range [][]string{
+		{"-pool", "missing-location"},
+		{"-pool", "dup=a.txt", "-pool", "dup=b.txt"},
+		{"-pool", "with-dash=a.txt"},
+		{"-pool", "a=a.txt", "-default-pool", "b"},
+	} {
+		if _, err := Load(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestLoadAdminRequiresToken(t *testing.T) {
+	t.Setenv("PROXY_ADMIN_LISTEN", "")
+	t.Setenv("PROXY_ADMIN_TOKEN", "")
+
+	if _, err := Load([]string{"-admin-listen", "127.0.0.1:9090"}); err == nil {
+		t.Fatalf("expected error for admin listener without token")
+	}
+
+	t.Setenv("PROXY_ADMIN_TOKEN", "secret")
+	cfg, err := Load([]string{"-admin-listen", "127.0.0.1:9090"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if cfg.Admin.ListenAddr != "127.0.0.1:9090" || cfg.Admin.Token != "secret" {
+		t.Fatalf("unexpected admin config: %+v", cfg.Admin)
+	}
+}
+
+func TestLoadTimeouts(t *testing.T) {
+	t.Setenv("PROXY_DIAL_TIMEOUT", "")
+	t.Setenv("PROXY_HANDSHAKE_TIMEOUT", "")
+	t.Setenv("PROXY_IDLE_TIMEOUT", "")
+	t.Setenv("PROXY_REQUEST_TIMEOUT", "")
+	t.Setenv("PROXY_RESPONSE_TIMEOUT", "")
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if want := (TimeoutConfig{Dial: 10 * time.Second, Handshake: 30 * time.Second}); cfg.Timeouts != want {
+		t.Fatalf("unexpected default timeouts: %+v", cfg.Timeouts)
+	}
+
+	t.Setenv("PROXY_IDLE_TIMEOUT", "5m")
+	t.Setenv("PROXY_REQUEST_TIMEOUT", "1m")
+	cfg, err = Load([]string{"-dial-timeout", "2s", "-handshake-timeout", "0", "-response-timeout", "20s"})
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	want := TimeoutConfig{Dial: 2 * time.Second, Idle: 5 * time.Minute, Request: time.Minute, Response: 20 * time.Second}
+	if cfg.Timeouts != want {
+		t.Fatalf("expected %+v, got %+v", want, cfg.Timeouts)
+	}
+}
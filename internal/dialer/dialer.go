@@ -0,0 +1,209 @@
+// Package dialer opens connections through upstream proxies, with exactly one
+// dial strategy per proxy protocol.
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+var (
+	// ErrUpstreamAuth indicates the upstream proxy rejected the supplied credentials.
+	ErrUpstreamAuth = errors.New("upstream authentication failed")
+	// ErrTargetRefused indicates the upstream is healthy but could not reach the target.
+	ErrTargetRefused = errors.New("upstream refused target")
+	// ErrTargetTimeout indicates the upstream accepted the request but the target did not answer in time.
+	ErrTargetTimeout = errors.New("target did not respond in time")
+	// ErrNetwork indicates the upstream proxy itself could not be reached or misbehaved.
+	ErrNetwork = errors.New("upstream network error")
+	// ErrUnsupportedProtocol indicates no dial strategy exists for the proxy protocol.
+	ErrUnsupportedProtocol = errors.New("unsupported proxy protocol")
+)
+
+// Error describes a failed dial through an upstream proxy.
+type Error struct {
+	// Kind is one of ErrUpstreamAuth, ErrTargetRefused, ErrTargetTimeout, ErrNetwork or ErrUnsupportedProtocol.
+	Kind     error
+	Upstream string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Upstream, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Upstream, e.Kind, e.Err)
+}
+
+// Unwrap exposes both the error kind and the underlying cause to errors.Is/As.
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// ForwardFunc dials the upstream proxy itself.
+type ForwardFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Options configures dialers.
+type Options struct {
+	// Forward dials the upstream proxy. Defaults to a plain net.Dialer.
+	Forward ForwardFunc
+	// DialTimeout bounds connecting to the upstream proxy; zero means no limit.
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds opening a tunnel, from the dial until the upstream
+	// confirms it; zero means no limit.
+	HandshakeTimeout time.Duration
+}
+
+// Dialer opens tunnels to targets through a single upstream proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Forwarder is implemented by dialers whose upstream accepts absolute-URI HTTP
+// requests, letting plain HTTP be forwarded without a CONNECT tunnel.
+type Forwarder interface {
+	// DialProxy connects to the upstream proxy itself.
+	DialProxy(ctx context.Context, network string) (net.Conn, error)
+}
+
+// For returns the dial strategy for the upstream's protocol.
+func For(upstream proxy.Proxy, opts Options) (Dialer, error) {
+	forward := opts.Forward
+	if forward == nil {
+		var d net.Dialer
+		forward = d.DialContext
+	}
+	if opts.DialTimeout > 0 {
+		forward = timeoutForward(forward, opts.DialTimeout)
+	}
+
+	switch upstream.Protocol {
+	case proxy.ProtocolHTTP, proxy.ProtocolHTTPS:
+		return &httpDialer{upstream: upstream, forward: forward, handshakeTimeout: opts.HandshakeTimeout}, nil
+	case proxy.ProtocolSOCKS5:
+		return &socks5Dialer{upstream: upstream, forward: forward, handshakeTimeout: opts.HandshakeTimeout}, nil
+	case proxy.ProtocolSOCKS4, proxy.ProtocolSOCKS4A:
+		return &socks4Dialer{upstream: upstream, forward: forward, handshakeTimeout: opts.HandshakeTimeout}, nil
+	default:
+		return nil, &Error{Kind: ErrUnsupportedProtocol, Upstream: describe(upstream), Err: fmt.Errorf("protocol %q", upstream.Protocol)}
+	}
+}
+
+// Supported reports whether a dial strategy exists for the protocol.
+func Supported(protocol string) bool {
+	_, err := For(proxy.Proxy{Protocol: protocol}, Options{})
+	return err == nil
+}
+
+// IsUpstreamFault reports whether err is attributable to the upstream proxy rather than the target.
+func IsUpstreamFault(err error) bool {
+	return err != nil && !errors.Is(err, ErrTargetRefused) && !errors.Is(err, ErrTargetTimeout)
+}
+
+// Class returns a short, stable name for the kind of dial failure, suitable for
+// reports and logs: "upstream_auth", "target_refused", "target_timeout",
+// "network", "unsupported_protocol", "timeout" or "other". It returns "" for a nil error.
+func Class(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrUpstreamAuth):
+		return "upstream_auth"
+	case errors.Is(err, ErrTargetRefused):
+		return "target_refused"
+	case errors.Is(err, ErrTargetTimeout):
+		return "target_timeout"
+	case errors.Is(err, ErrUnsupportedProtocol):
+		return "unsupported_protocol"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrNetwork):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+func describe(upstream proxy.Proxy) string {
+	return upstream.Protocol + "://" + upstream.Address
+}
+
+func newError(kind error, upstream proxy.Proxy, err error) error {
+	return &Error{Kind: kind, Upstream: describe(upstream), Err: err}
+}
+
+// forwardError marks failures reaching the upstream proxy itself.
+type forwardError struct {
+	err error
+}
+
+func (e *forwardError) Error() string { return e.err.Error() }
+func (e *forwardError) Unwrap() error { return e.err }
+
+func wrapForward(forward ForwardFunc) ForwardFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, addr)
+		if err != nil {
+			return nil, &forwardError{err: err}
+		}
+		return conn, nil
+	}
+}
+
+func timeoutForward(forward ForwardFunc, timeout time.Duration) ForwardFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return forward(ctx, network, addr)
+	}
+}
+
+// withTimeout bounds ctx by timeout; a zero timeout leaves ctx unchanged.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// bindContext makes blocking I/O on conn fail once ctx is done, for protocol
+// code that only speaks to a net.Conn. The returned func detaches conn again
+// and reports ctx's error if ctx ended before it was called.
+func bindContext(ctx context.Context, conn net.Conn) func() error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// A deadline in the past unblocks pending reads and writes.
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() error {
+		if !stop() {
+			return ctx.Err()
+		}
+		return conn.SetDeadline(time.Time{})
+	}
+}
+
+// ContextError prefers ctx's error over err, which is then usually a symptom
+// such as an expired connection deadline. A connection deadline can fire just
+// before ctx's own timer, so a passed deadline counts as well. With a nil err it
+// reports whether the request timed out or the client left.
+func ContextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+// startConnectProxy answers every CONNECT with the given status line.
+func startConnectProxy(t *testing.T, status string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\n\r\n"))
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+// startSilentUpstream accepts connections and never answers, like a black-holed proxy.
+func startSilentUpstream(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		_ = listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestDialClassifiesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream proxy.Proxy
+		want     error
+	}{
+		{"http auth rejected", proxy.Proxy{Protocol: "http", Address: startConnectProxy(t, "407 Proxy Authentication Required")}, ErrUpstreamAuth},
+		{"http target refused", proxy.Proxy{Protocol: "http", Address: startConnectProxy(t, "502 Bad Gateway")}, ErrTargetRefused},
+		{"http unreachable", proxy.Proxy{Protocol: "http", Address: closedAddress(t)}, ErrNetwork},
+		{"socks5 unreachable", proxy.Proxy{Protocol: "socks5", Address: closedAddress(t)}, ErrNetwork},
+		{"socks4 unreachable", proxy.Proxy{Protocol: "socks4", Address: closedAddress(t)}, ErrNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := For(tt.upstream, Options{})
+			if err != nil {
+				t.Fatalf("For returned error: %v", err)
+			}
+
+			_, err = d.DialContext(context.Background(), "tcp", "192.0.2.1:443")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSocks5DoesNotFallBackToConnect(t *testing.T) {
+	attempts := 0
+	forward := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("refused")
+	}
+
+	d, err := For(proxy.Proxy{Protocol: "socks5", Address: "127.0.0.1:1080"}, Options{Forward: forward})
+	if err != nil {
+		t.Fatalf("For returned error: %v", err)
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); !errors.Is(err, ErrNetwork) {
+		t.Fatalf("expected network error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected a single dial attempt, got %d", attempts)
+	}
+}
+
+func TestForRejectsUnknownProtocol(t *testing.T) {
+	if _, err := For(proxy.Proxy{Protocol: "ftp", Address: "host:21"}, Options{}); !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Fatalf("expected ErrUnsupportedProtocol, got %v", err)
+	}
+	if Supported("htpp") {
+		t.Fatalf("expected typo protocol to be unsupported")
+	}
+}
+
+func TestEveryListProtocolHasDialer(t *testing.T) {
+	// proxy validates lists against proxy.Protocols, so each one must be dialable.
+	for _, protocol := range proxy.Protocols() {
+		if !Supported(protocol) {
+			t.Fatalf("protocol %q is accepted in proxy lists but has no dialer", protocol)
+		}
+	}
+}
+
+func TestHandshakeTimeoutOnSilentUpstream(t *testing.T) {
+	for _, protocol := range []string{"http", "https", "socks5", "socks4"} {
+		t.Run(protocol, func(t *testing.T) {
+			d, err := For(proxy.Proxy{Protocol: protocol, Address: startSilentUpstream(t)}, Options{HandshakeTimeout: 100 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("For returned error: %v", err)
+			}
+
+			started := time.Now()
+			_, err = d.DialContext(context.Background(), "tcp", "192.0.2.1:443")
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				t.Fatalf("dial took %s despite the handshake timeout", elapsed)
+			}
+			if !errors.Is(err, ErrNetwork) || Class(err) != "timeout" {
+				t.Fatalf("expected network timeout, got %q: %v", Class(err), err)
+			}
+		})
+	}
+}
+
+func TestDialHonorsCancellation(t *testing.T) {
+	for _, protocol := range []string{"http", "socks5", "socks4"} {
+		t.Run(protocol, func(t *testing.T) {
+			d, err := For(proxy.Proxy{Protocol: protocol, Address: startSilentUpstream(t)}, Options{})
+			if err != nil {
+				t.Fatalf("For returned error: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := d.DialContext(ctx, "tcp", "192.0.2.1:443")
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("expected cancellation, got %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("dial ignored context cancellation")
+			}
+		})
+	}
+}
+
+func TestDialTimeoutBoundsUpstreamConnect(t *testing.T) {
+	forward := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	d, err := For(proxy.Proxy{Protocol: "http", Address: "192.0.2.1:8080"}, Options{Forward: forward, DialTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("For returned error: %v", err)
+	}
+
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); !errors.Is(err, ErrNetwork) || Class(err) != "timeout" {
+		t.Fatalf("expected network timeout, got %q: %v", Class(err), err)
+	}
+}
+
+func TestTransportHonorsRequestDeadlineOnSilentUpstream(t *testing.T) {
+	transport, err := NewTransport(proxy.Proxy{Protocol: "http", Address: startSilentUpstream(t)}, Options{HandshakeTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewTransport returned error: %v", err)
+	}
+	defer transport.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.invalid/", nil)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the request deadline to end the request, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("request hung on a silent upstream")
+	}
+}
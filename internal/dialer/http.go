@@ -0,0 +1,183 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+)
+
+const errorRespMaxLength = 500
+
+// httpDialer tunnels through HTTP and HTTPS proxies using CONNECT.
+type httpDialer struct {
+	upstream         proxy.Proxy
+	forward          ForwardFunc
+	handshakeTimeout time.Duration
+}
+
+func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.handshakeTimeout)
+	defer cancel()
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if d.upstream.Credentials != nil {
+		auth.SetProxyAuthorization(connectReq, *d.upstream.Credentials)
+	}
+
+	conn, err := d.DialProxy(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+
+	// Neither the request write nor the response read observes ctx on its own.
+	unbind := bindContext(ctx, conn)
+	tunnel, err := d.connect(ctx, conn, connectReq)
+	if unbindErr := unbind(); err == nil && unbindErr != nil {
+		err = newError(ErrNetwork, d.upstream, fmt.Errorf("read CONNECT response: %w", unbindErr))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect sends the CONNECT request over conn and waits for the upstream to accept it.
+func (d *httpDialer) connect(ctx context.Context, conn net.Conn, connectReq *http.Request) (net.Conn, error) {
+	if err := connectReq.Write(conn); err != nil {
+		return nil, newError(ErrNetwork, d.upstream, fmt.Errorf("write CONNECT: %w", ContextError(ctx, err)))
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		return nil, newError(ErrNetwork, d.upstream, fmt.Errorf("read CONNECT response: %w", ContextError(ctx, err)))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, errorRespMaxLength))
+
+		kind := ErrTargetRefused
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			kind = ErrUpstreamAuth
+		}
+		return nil, newError(kind, d.upstream, fmt.Errorf("proxy refused connection: %s: %s", resp.Status, body))
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// DialProxy connects to the proxy itself, completing a TLS handshake for https upstreams.
+func (d *httpDialer) DialProxy(ctx context.Context, network string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.handshakeTimeout)
+	defer cancel()
+
+	host := HostPort(d.upstream)
+
+	conn, err := d.forward(ctx, network, host)
+	if err != nil {
+		return nil, newError(ErrNetwork, d.upstream, err)
+	}
+
+	if d.upstream.Protocol != "https" {
+		return conn, nil
+	}
+
+	serverName, _, _ := net.SplitHostPort(host)
+	tlsConfig, err := d.upstream.TLS.ClientConfig(serverName)
+	if err != nil {
+		_ = conn.Close()
+		return nil, newError(ErrNetwork, d.upstream, fmt.Errorf("tls config: %w", err))
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, newError(ErrNetwork, d.upstream, fmt.Errorf("tls handshake: %w", err))
+	}
+	return tlsConn, nil
+}
+
+// NewTransport returns an http.Transport that sends requests through the upstream.
+// HTTP(S) upstreams receive absolute-URI requests; other protocols tunnel each connection.
+func NewTransport(upstream proxy.Proxy, opts Options) (*http.Transport, error) {
+	d, err := For(upstream, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+
+	forwarder, ok := d.(Forwarder)
+	if !ok {
+		transport.DialContext = d.DialContext
+		return transport, nil
+	}
+
+	// The upstream connection (TLS included) is owned by the dialer, so the
+	// transport always speaks plain HTTP proxy protocol over it.
+	forwardURL := &url.URL{Scheme: "http", Host: HostPort(upstream)}
+	if upstream.Credentials != nil && upstream.Credentials.IsValid() {
+		forwardURL.User = url.UserPassword(upstream.Credentials.Username, upstream.Credentials.Password)
+	}
+	transport.Proxy = http.ProxyURL(forwardURL)
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return forwarder.DialProxy(ctx, network)
+	}
+	return transport, nil
+}
+
+// HostPort returns the upstream address, adding the protocol's default port when missing.
+func HostPort(upstream proxy.Proxy) string {
+	host := upstream.Address
+	if containsPort(host) {
+		return host
+	}
+	host = strings.Trim(host, "[]")
+	if port := proxy.DefaultPort(upstream.Protocol); port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return net.JoinHostPort(host, proxy.DefaultPort(proxy.ProtocolHTTP))
+}
+
+func containsPort(host string) bool {
+	for i := len(host) - 1; i >= 0; i-- {
+		if host[i] == ':' {
+			return true
+		}
+		if host[i] == ']' {
+			break
+		}
+	}
+	return false
+}
+
+// bufferedConn replays bytes read past the CONNECT response before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,117 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	socks "golang.org/x/net/proxy"
+
+	"proxygate/internal/proxy"
+	"proxygate/internal/socks4"
+)
+
+// socks5Dialer tunnels through SOCKS5 proxies.
+type socks5Dialer struct {
+	upstream         proxy.Proxy
+	forward          ForwardFunc
+	handshakeTimeout time.Duration
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.handshakeTimeout)
+	defer cancel()
+
+	var credentials *socks.Auth
+	if d.upstream.Credentials != nil && d.upstream.Credentials.IsValid() {
+		credentials = &socks.Auth{
+			User:     d.upstream.Credentials.Username,
+			Password: d.upstream.Credentials.Password,
+		}
+	}
+
+	dialer, err := socks.SOCKS5("tcp", HostPort(d.upstream), credentials, contextForward(wrapForward(d.forward)))
+	if err != nil {
+		return nil, newError(ErrNetwork, d.upstream, err)
+	}
+
+	conn, err := dialer.(socks.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, newError(classifySocks5(err), d.upstream, ContextError(ctx, err))
+	}
+	return conn, nil
+}
+
+// classifySocks5 maps golang.org/x/net/proxy errors, which are untyped, onto error kinds.
+func classifySocks5(err error) error {
+	var fwdErr *forwardError
+	if errors.As(err, &fwdErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrNetwork
+	}
+
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "authentication"), strings.Contains(message, "username/password"):
+		return ErrUpstreamAuth
+	case strings.Contains(message, "unknown error "):
+		// The server answered the CONNECT command with a non-success reply code.
+		return ErrTargetRefused
+	default:
+		return ErrNetwork
+	}
+}
+
+// socks4Dialer tunnels through SOCKS4 and SOCKS4a proxies.
+type socks4Dialer struct {
+	upstream         proxy.Proxy
+	forward          ForwardFunc
+	handshakeTimeout time.Duration
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.handshakeTimeout)
+	defer cancel()
+
+	dialer := &socks4.Dialer{
+		ProxyAddress: HostPort(d.upstream),
+		RemoteDNS:    d.upstream.Protocol == "socks4a",
+		Forward:      wrapForward(d.forward),
+	}
+	if d.upstream.Credentials != nil {
+		dialer.UserID = d.upstream.Credentials.Username
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, newError(classifySocks4(err), d.upstream, ContextError(ctx, err))
+	}
+	return conn, nil
+}
+
+func classifySocks4(err error) error {
+	var replyErr *socks4.ReplyError
+	if errors.As(err, &replyErr) {
+		if replyErr.IdentRejected() {
+			return ErrUpstreamAuth
+		}
+		return ErrTargetRefused
+	}
+	if errors.Is(err, socks4.ErrUnsupportedAddress) {
+		return ErrTargetRefused
+	}
+	return ErrNetwork
+}
+
+// contextForward adapts a ForwardFunc to the x/net proxy.Dialer interfaces.
+type contextForward ForwardFunc
+
+func (f contextForward) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f contextForward) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
@@ -0,0 +1,253 @@
+// Package health actively probes upstream proxies and reports their status to the pool.
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxygate/internal/dialer"
+	"proxygate/internal/proxy"
+)
+
+// Probe modes.
+const (
+	ModeTCP     = "tcp"
+	ModeConnect = "connect"
+	ModeHTTP    = "http"
+)
+
+const (
+	defaultInterval      = 30 * time.Second
+	defaultTimeout       = 10 * time.Second
+	defaultFailThreshold = 3
+	defaultRiseThreshold = 2
+	defaultConnectTarget = "www.google.com:443"
+	defaultHTTPTarget    = "http://www.gstatic.com/generate_204"
+	maxConcurrentProbes  = 32
+)
+
+// Options configures a Checker.
+type Options struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Mode is one of ModeTCP, ModeConnect or ModeHTTP.
+	Mode string
+	// Target is the host:port tunneled to in connect mode, or the URL fetched in http mode.
+	Target string
+	// FailThreshold consecutive failures mark an upstream unhealthy.
+	FailThreshold int
+	// RiseThreshold consecutive successes bring an unhealthy upstream back.
+	RiseThreshold int
+	Dialer        dialer.Options
+}
+
+// Checker periodically probes every upstream in a pool.
+type Checker struct {
+	pool *proxy.Pool
+	opts Options
+
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+type counter struct {
+	failures  int
+	successes int
+}
+
+// New constructs a Checker, applying defaults for unset options.
+func New(pool *proxy.Pool, opts Options) (*Checker, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.FailThreshold <= 0 {
+		opts.FailThreshold = defaultFailThreshold
+	}
+	if opts.RiseThreshold <= 0 {
+		opts.RiseThreshold = defaultRiseThreshold
+	}
+
+	switch opts.Mode {
+	case "", ModeTCP:
+		opts.Mode = ModeTCP
+	case ModeConnect:
+		if opts.Target == "" {
+			opts.Target = defaultConnectTarget
+		}
+	case ModeHTTP:
+		if opts.Target == "" {
+			opts.Target = defaultHTTPTarget
+		}
+	default:
+		return nil, fmt.Errorf("unknown health check mode %q", opts.Mode)
+	}
+
+	return &Checker{
+		pool:     pool,
+		opts:     opts,
+		counters: make(map[string]*counter),
+	}, nil
+}
+
+// Run probes the pool every interval until ctx is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	log.Printf("Health checking every %s using %s probes", c.opts.Interval, c.opts.Mode)
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll probes every upstream once and updates the pool.
+func (c *Checker) CheckAll(ctx context.Context) {
+	proxies := c.pool.Proxies()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentProbes)
+	for _, upstream := range proxies {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(upstream proxy.Proxy) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := c.Probe(ctx, upstream)
+			if ctx.Err() != nil {
+				return
+			}
+			c.record(upstream, err)
+		}(upstream)
+	}
+	wg.Wait()
+
+	c.prune(proxies)
+}
+
+// Probe runs a single health probe against the upstream.
+func (c *Checker) Probe(ctx context.Context, upstream proxy.Proxy) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	switch c.opts.Mode {
+	case ModeConnect:
+		return c.probeConnect(ctx, upstream)
+	case ModeHTTP:
+		return c.probeHTTP(ctx, upstream)
+	default:
+		return c.probeTCP(ctx, upstream)
+	}
+}
+
+func (c *Checker) probeTCP(ctx context.Context, upstream proxy.Proxy) error {
+	forward := c.opts.Dialer.Forward
+	if forward == nil {
+		var d net.Dialer
+		forward = d.DialContext
+	}
+	conn, err := forward(ctx, "tcp", dialer.HostPort(upstream))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Checker) probeConnect(ctx context.Context, upstream proxy.Proxy) error {
+	d, err := dialer.For(upstream, c.opts.Dialer)
+	if err != nil {
+		return err
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.opts.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *Checker) probeHTTP(ctx context.Context, upstream proxy.Proxy) error {
+	transport, err := dialer.NewTransport(upstream, c.opts.Dialer)
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.opts.Target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusProxyAuthRequired {
+		return fmt.Errorf("probe returned %s", resp.Status)
+	}
+	return nil
+}
+
+// record applies fall/rise thresholds and reports transitions to the pool.
+func (c *Checker) record(upstream proxy.Proxy, err error) {
+	c.mu.Lock()
+	key := upstream.Key()
+	cnt, ok := c.counters[key]
+	if !ok {
+		cnt = &counter{}
+		c.counters[key] = cnt
+	}
+
+	transition, healthy := false, err == nil
+	if healthy {
+		cnt.failures = 0
+		cnt.successes++
+		transition = cnt.successes == c.opts.RiseThreshold
+	} else {
+		cnt.successes = 0
+		cnt.failures++
+		transition = cnt.failures == c.opts.FailThreshold
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Health probe failed for %s://%s: %v", upstream.Protocol, upstream.Address, err)
+	}
+	if transition {
+		c.pool.SetHealthy(upstream, healthy)
+	}
+}
+
+// prune forgets counters for upstreams no longer in the pool.
+func (c *Checker) prune(proxies []proxy.Proxy) {
+	present := make(map[string]struct{}, len(proxies))
+	for _, upstream := range proxies {
+		present[upstream.Key()] = struct{}{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.counters {
+		if _, ok := present[key]; !ok {
+			delete(c.counters, key)
+		}
+	}
+}
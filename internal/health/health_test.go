@@ -0,0 +1,82 @@
+package health
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"proxygate/internal/proxy"
+)
+
+func TestCheckerRemovesAndRestoresUpstreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	alive := proxy.Proxy{Protocol: "http", Address: listener.Addr().String()}
+	dead := proxy.Proxy{Protocol: "http", Address: deadAddr}
+
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{alive, dead})
+
+	checker, err := New(pool, Options{Mode: ModeTCP, FailThreshold: 2, RiseThreshold: 2})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	checker.CheckAll(context.Background())
+	if !pool.Healthy(dead) {
+		t.Fatalf("expected upstream to stay healthy below the failure threshold")
+	}
+
+	checker.CheckAll(context.Background())
+	if pool.Healthy(dead) {
+		t.Fatalf("expected dead upstream to be marked unhealthy")
+	}
+	if !pool.Healthy(alive) {
+		t.Fatalf("expected live upstream to stay healthy")
+	}
+
+	for i := 0; i < 20; i++ {
+		selected, _, err := pool.Select("", nil)
+		if err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+		if selected.Address != alive.Address {
+			t.Fatalf("expected unhealthy upstream to be excluded, got %s", selected.Address)
+		}
+	}
+
+	checker.record(dead, nil)
+	if pool.Healthy(dead) {
+		t.Fatalf("expected upstream to stay unhealthy below the rise threshold")
+	}
+	checker.record(dead, nil)
+	if !pool.Healthy(dead) {
+		t.Fatalf("expected upstream to recover after the rise threshold")
+	}
+}
+
+func TestNewRejectsUnknownMode(t *testing.T) {
+	if _, err := New(proxy.NewPool(proxy.Options{}), Options{Mode: "icmp"}); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,275 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the histogram upper bounds in seconds, matching the Prometheus client defaults.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	addFloat(&c.bits, delta)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	addFloat(&g.bits, delta)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func addFloat(bits *atomic.Uint64, delta float64) {
+	for {
+		old := bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records a single value.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// vec holds one metric per distinct combination of label values.
+type vec[M any] struct {
+	name   string
+	help   string
+	labels []string
+	create func() *M
+
+	mu     sync.RWMutex
+	series map[string]*series[M]
+}
+
+type series[M any] struct {
+	values []string
+	metric *M
+}
+
+func newVec[M any](name, help string, labels []string, create func() *M) *vec[M] {
+	return &vec[M]{name: name, help: help, labels: labels, create: create, series: make(map[string]*series[M])}
+}
+
+// With returns the metric for the given label values, creating it on first use.
+// Values are matched to labels by position.
+func (v *vec[M]) With(values ...string) *M {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	s = &series[M]{values: append([]string(nil), values...), metric: v.create()}
+	v.series[key] = s
+	return s.metric
+}
+
+// sorted returns the series ordered by label values so output is stable.
+func (v *vec[M]) sorted() []*series[M] {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := make([]*series[M], 0, len(keys))
+	for _, key := range keys {
+		out = append(out, v.series[key])
+	}
+	return out
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct{ *vec[Counter] }
+
+// NewCounterVec creates a counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labels, func() *Counter { return &Counter{} })}
+}
+
+func (v *CounterVec) writeTo(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	for _, s := range v.sorted() {
+		writeSample(w, v.name, v.labels, s.values, s.metric.Value())
+	}
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct{ *vec[Gauge] }
+
+// NewGaugeVec creates a gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, labels, func() *Gauge { return &Gauge{} })}
+}
+
+func (v *GaugeVec) writeTo(w io.Writer) {
+	writeHeader(w, v.name, v.help, "gauge")
+	for _, s := range v.sorted() {
+		writeSample(w, v.name, v.labels, s.values, s.metric.Value())
+	}
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct{ *vec[Histogram] }
+
+// NewHistogramVec creates a histogram family with the given bucket upper bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, labels, func() *Histogram { return newHistogram(buckets) })}
+}
+
+func (v *HistogramVec) writeTo(w io.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	labels := append(append([]string(nil), v.labels...), "le")
+	for _, s := range v.sorted() {
+		h := s.metric
+		h.mu.Lock()
+		for i, bound := range h.buckets {
+			writeSample(w, v.name+"_bucket", labels, withValue(s.values, formatFloat(bound)), float64(h.counts[i]))
+		}
+		writeSample(w, v.name+"_bucket", labels, withValue(s.values, "+Inf"), float64(h.count))
+		writeSample(w, v.name+"_sum", v.labels, s.values, h.sum)
+		writeSample(w, v.name+"_count", v.labels, s.values, float64(h.count))
+		h.mu.Unlock()
+	}
+}
+
+// withValue copies values and appends one more, leaving the series' slice untouched.
+func withValue(values []string, value string) []string {
+	return append(append(make([]string, 0, len(values)+1), values...), value)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family.
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample writes one sample line in the Prometheus text exposition format.
+func writeSample(w io.Writer, name string, labels, values []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label)
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(values[i]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	_, _ = io.WriteString(w, b.String())
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,177 @@
+// Package metrics records proxy traffic and pool state and exposes it in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+// Request kinds used as the "kind" label.
+const (
+	KindConnect = "connect"
+	KindHTTP    = "http"
+)
+
+// Byte directions used as the "direction" label: in is received from the
+// upstream and sent to the client, out is sent from the client to the upstream.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// ResultOK is the "result" label of a request that reached its target.
+const ResultOK = "ok"
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics is the set of metrics recorded by the proxy server.
+type Metrics struct {
+	// Requests counts client requests by kind, pool and result, an error class or "ok".
+	Requests *CounterVec
+	// RequestDuration measures the time to establish a tunnel or receive response headers.
+	RequestDuration *HistogramVec
+	// DialDuration measures successful upstream dials per proxy.
+	DialDuration *HistogramVec
+	// Retries counts attempts made against a replacement upstream.
+	Retries *CounterVec
+	// Failures counts upstreams marked as failed.
+	Failures *CounterVec
+	// ActiveTunnels is the number of open CONNECT tunnels.
+	ActiveTunnels *GaugeVec
+	// Bytes counts payload bytes moved through tunnels and forwarded requests.
+	Bytes *CounterVec
+}
+
+// New creates an empty metric set.
+func New() *Metrics {
+	return &Metrics{
+		Requests:        NewCounterVec("proxygate_requests_total", "Client requests by kind, pool and result.", "kind", "pool", "result"),
+		RequestDuration: NewHistogramVec("proxygate_request_duration_seconds", "Time to establish a CONNECT tunnel or receive HTTP response headers.", DefaultBuckets, "kind", "pool"),
+		DialDuration:    NewHistogramVec("proxygate_upstream_dial_duration_seconds", "Latency of successful dials through an upstream proxy.", DefaultBuckets, "pool", "proxy"),
+		Retries:         NewCounterVec("proxygate_upstream_retries_total", "Requests retried against a replacement upstream.", "kind", "pool"),
+		Failures:        NewCounterVec("proxygate_upstream_failures_total", "Upstreams marked as failed.", "pool", "proxy"),
+		ActiveTunnels:   NewGaugeVec("proxygate_active_tunnels", "Open CONNECT tunnels.", "pool"),
+		Bytes:           NewCounterVec("proxygate_bytes_total", "Payload bytes by kind, pool and direction (in: upstream to client, out: client to upstream).", "kind", "pool", "direction"),
+	}
+}
+
+// ObserveDial records a successful dial through the upstream.
+func (m *Metrics) ObserveDial(pool string, upstream proxy.Proxy, latency time.Duration) {
+	m.DialDuration.With(pool, upstream.Key()).Observe(latency.Seconds())
+}
+
+// ObserveRequest counts a finished request and its duration.
+func (m *Metrics) ObserveRequest(kind, pool, result string, elapsed time.Duration) {
+	m.Requests.With(kind, pool, result).Inc()
+	m.RequestDuration.With(kind, pool).Observe(elapsed.Seconds())
+}
+
+// Server serves the metrics under /metrics on a listener of its own.
+type Server struct {
+	httpServer *http.Server
+}
+
+// NewServer returns a Server for addr.
+func NewServer(addr string, m *Metrics, pools *proxy.Registry) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler(m, pools))
+	return &Server{httpServer: &http.Server{Addr: addr, Handler: mux}}
+}
+
+// ListenAndServe starts the metrics listener. It returns nil once Shutdown has been called.
+func (s *Server) ListenAndServe() error {
+	log.Printf("Starting metrics listener on %s", s.httpServer.Addr)
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown closes the listener and waits for in-flight scrapes until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Handler serves the recorded metrics followed by the current state of every pool.
+func Handler(m *Metrics, pools *proxy.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var buf bytes.Buffer
+		m.WriteText(&buf)
+		if pools != nil {
+			writePools(&buf, pools)
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Printf("Metrics response failed: %v", err)
+		}
+	})
+}
+
+// WriteText writes the recorded metrics in the text exposition format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.Requests.writeTo(w)
+	m.RequestDuration.writeTo(w)
+	m.DialDuration.writeTo(w)
+	m.Retries.writeTo(w)
+	m.Failures.writeTo(w)
+	m.ActiveTunnels.writeTo(w)
+	m.Bytes.writeTo(w)
+}
+
+// writePools reports pool size, sticky sessions and per-upstream state, read at scrape time.
+func writePools(w io.Writer, pools *proxy.Registry) {
+	size := NewGaugeVec("proxygate_pool_proxies", "Upstreams loaded in the pool.", "pool")
+	available := NewGaugeVec("proxygate_pool_available_proxies", "Upstreams that are healthy, enabled, not circuit-open and below max_conns.", "pool")
+	sessions := NewGaugeVec("proxygate_sticky_sessions", "Sticky sessions held by the pool.", "pool")
+	healthy := NewGaugeVec("proxygate_upstream_healthy", "Whether the upstream passes health checks (1) or not (0).", "pool", "proxy")
+	circuit := NewGaugeVec("proxygate_upstream_circuit_open", "Whether the upstream's circuit breaker is open (1) or not (0).", "pool", "proxy")
+	active := NewGaugeVec("proxygate_upstream_active_connections", "Connections currently using the upstream.", "pool", "proxy")
+
+	for _, name := range pools.Names() {
+		pool, err := pools.Get(name)
+		if err != nil {
+			continue
+		}
+
+		size.With(name).Add(float64(pool.Len()))
+		sessions.With(name).Add(float64(pool.SessionCount()))
+		available.With(name)
+		for _, stats := range pool.Stats() {
+			key := stats.Proxy.Key()
+			healthy.With(name, key).Add(boolValue(stats.Healthy))
+			circuit.With(name, key).Add(boolValue(stats.Circuit == "open"))
+			active.With(name, key).Add(float64(stats.ActiveConns))
+			if eligible(stats) {
+				available.With(name).Inc()
+			}
+		}
+	}
+
+	for _, gauge := range []*GaugeVec{size, available, sessions, healthy, circuit, active} {
+		gauge.writeTo(w)
+	}
+}
+
+// eligible mirrors the pool's availability rules without advancing breaker state.
+func eligible(stats proxy.Stats) bool {
+	if !stats.Healthy || stats.Disabled || stats.Circuit == "open" {
+		return false
+	}
+	return stats.Proxy.MaxConns == 0 || stats.ActiveConns < stats.Proxy.MaxConns
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
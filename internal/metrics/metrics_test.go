@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+)
+
+func TestWriteTextFormat(t *testing.T) {
+	m := New()
+	m.Requests.With(KindConnect, "default", ResultOK).Add(2)
+	m.Requests.With(KindHTTP, "default", "network").Inc()
+	m.ObserveRequest(KindHTTP, "default", ResultOK, 30*time.Millisecond)
+	m.ActiveTunnels.With("default").Inc()
+	m.ActiveTunnels.With("default").Dec()
+	m.Bytes.With(KindConnect, `we"ird`, DirectionIn).Add(512)
+
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# HELP proxygate_requests_total Client requests by kind, pool and result.\n",
+		"# TYPE proxygate_requests_total counter\n",
+		`proxygate_requests_total{kind="connect",pool="default",result="ok"} 2` + "\n",
+		`proxygate_requests_total{kind="http",pool="default",result="network"} 1` + "\n",
+		"# TYPE proxygate_request_duration_seconds histogram\n",
+		`proxygate_request_duration_seconds_bucket{kind="http",pool="default",le="0.025"} 0` + "\n",
+		`proxygate_request_duration_seconds_bucket{kind="http",pool="default",le="0.05"} 1` + "\n",
+		`proxygate_request_duration_seconds_bucket{kind="http",pool="default",le="+Inf"} 1` + "\n",
+		`proxygate_request_duration_seconds_sum{kind="http",pool="default"} 0.03` + "\n",
+		`proxygate_request_duration_seconds_count{kind="http",pool="default"} 1` + "\n",
+		`proxygate_active_tunnels{pool="default"} 0` + "\n",
+		`proxygate_bytes_total{kind="connect",pool="we\"ird",direction="in"} 512` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandlerReportsPoolState(t *testing.T) {
+	pool := proxy.NewPool(proxy.Options{})
+	healthy := proxy.Proxy{Protocol: "http", Address: "10.0.0.1:8080", Credentials: &auth.Credentials{Username: "user", Password: "hunter2"}}
+	down := proxy.Proxy{Protocol: "socks5", Address: "10.0.0.2:1080"}
+	pool.SetProxies([]proxy.Proxy{healthy, down})
+	pool.SetHealthy(down, false)
+	if _, _, err := pool.Select("session-1", nil); err != nil {
+		t.Fatalf("Select returned error: %v", err)
+	}
+
+	registry := proxy.NewRegistry()
+	if err := registry.Add("residential", pool); err != nil {
+		t.Fatalf("add pool: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(New(), registry).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := rec.Body.String()
+
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	if strings.Contains(out, "hunter2") {
+		t.Fatalf("metrics leak upstream password:\n%s", out)
+	}
+	for _, want := range []string{
+		`proxygate_pool_proxies{pool="residential"} 2`,
+		`proxygate_pool_available_proxies{pool="residential"} 1`,
+		`proxygate_sticky_sessions{pool="residential"} 1`,
+		`proxygate_upstream_healthy{pool="residential",proxy="http://user@10.0.0.1:8080"} 1`,
+		`proxygate_upstream_healthy{pool="residential",proxy="socks5://10.0.0.2:1080"} 0`,
+		`proxygate_upstream_circuit_open{pool="residential",proxy="socks5://10.0.0.2:1080"} 0`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestServerShutdownStopsListener(t *testing.T) {
+	srv := NewServer("127.0.0.1:0", New(), nil)
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected ListenAndServe to return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ListenAndServe did not return after Shutdown")
+	}
+}
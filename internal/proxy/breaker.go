@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// BreakerOptions configures the passive circuit breaker kept for every upstream.
+// A zero FailureThreshold disables the breaker.
+type BreakerOptions struct {
+	// FailureThreshold consecutive failures open the circuit.
+	FailureThreshold int
+	// ErrorRate opens the circuit once the failure ratio over the last Window outcomes reaches it.
+	ErrorRate float64
+	Window    int
+	// Cooldown is the first open period; it doubles on every re-open up to
+	// MaxCooldown, or without bound when MaxCooldown is zero.
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+	// HalfOpenTrials is the number of concurrent trial requests allowed once the cooldown elapses.
+	HalfOpenTrials int
+}
+
+// DefaultBreakerOptions returns the breaker settings used by the CLI.
+func DefaultBreakerOptions() BreakerOptions {
+	return BreakerOptions{
+		FailureThreshold: 5,
+		ErrorRate:        0.5,
+		Window:           20,
+		Cooldown:         10 * time.Second,
+		MaxCooldown:      5 * time.Minute,
+		HalfOpenTrials:   1,
+	}
+}
+
+func (o BreakerOptions) enabled() bool {
+	return o.FailureThreshold > 0
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks real-traffic outcomes for one upstream.
+type circuitBreaker struct {
+	state               circuitState
+	consecutiveFailures int
+	outcomes            []bool
+	next                int
+	opens               int
+	openUntil           time.Time
+	trials              int
+	trialStarted        time.Time
+}
+
+// allows reports whether a request may be sent, moving open circuits to half-open after the cooldown.
+func (b *circuitBreaker) allows(opts BreakerOptions, now time.Time) bool {
+	switch b.state {
+	case circuitOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trials = 0
+		return true
+	case circuitHalfOpen:
+		// Trials that never reported back are abandoned after one cooldown.
+		if b.trials > 0 && now.Sub(b.trialStarted) > opts.Cooldown {
+			b.trials = 0
+		}
+		return b.trials < opts.HalfOpenTrials
+	default:
+		return true
+	}
+}
+
+// acquire records that a request was dispatched to the upstream.
+func (b *circuitBreaker) acquire(now time.Time) {
+	if b.state == circuitHalfOpen {
+		b.trials++
+		b.trialStarted = now
+	}
+}
+
+// record applies an outcome and returns the new state when it changed.
+func (b *circuitBreaker) record(opts BreakerOptions, success bool, now time.Time) (circuitState, bool) {
+	previous := b.state
+	b.observe(opts, success)
+
+	switch {
+	case b.state == circuitHalfOpen && success:
+		b.reset()
+	case b.state == circuitHalfOpen:
+		b.trip(opts, now)
+	case b.state == circuitClosed && !success && b.shouldTrip(opts):
+		b.trip(opts, now)
+	}
+
+	return b.state, b.state != previous
+}
+
+func (b *circuitBreaker) observe(opts BreakerOptions, success bool) {
+	if success {
+		b.consecutiveFailures = 0
+	} else {
+		b.consecutiveFailures++
+	}
+
+	if opts.Window <= 0 {
+		return
+	}
+	if len(b.outcomes) < opts.Window {
+		b.outcomes = append(b.outcomes, success)
+		return
+	}
+	b.outcomes[b.next] = success
+	b.next = (b.next + 1) % opts.Window
+}
+
+func (b *circuitBreaker) shouldTrip(opts BreakerOptions) bool {
+	if b.consecutiveFailures >= opts.FailureThreshold {
+		return true
+	}
+	if opts.ErrorRate <= 0 || opts.Window <= 0 || len(b.outcomes) < opts.Window {
+		return false
+	}
+	return b.errorRate() >= opts.ErrorRate
+}
+
+func (b *circuitBreaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, success := range b.outcomes {
+		if !success {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.outcomes))
+}
+
+func (b *circuitBreaker) trip(opts BreakerOptions, now time.Time) {
+	cooldown := opts.Cooldown
+	for i := 0; i < b.opens && cooldown > 0 && cooldown <= math.MaxInt64/2; i++ {
+		if opts.MaxCooldown > 0 && cooldown >= opts.MaxCooldown {
+			break
+		}
+		cooldown *= 2
+	}
+	if opts.MaxCooldown > 0 && cooldown > opts.MaxCooldown {
+		cooldown = opts.MaxCooldown
+	}
+
+	b.state = circuitOpen
+	b.opens++
+	b.openUntil = now.Add(cooldown)
+	b.trials = 0
+	b.outcomes = b.outcomes[:0]
+	b.next = 0
+}
+
+func (b *circuitBreaker) reset() {
+	*b = circuitBreaker{}
+}
+
+// recordOutcome feeds a real-traffic outcome into the upstream's breaker.
+func (p *Pool) recordOutcome(upstream Proxy, success bool) {
+	if !p.breakerOpts.enabled() {
+		return
+	}
+
+	p.mu.Lock()
+	breaker := &p.stateLocked(upstream).breaker
+	state, changed := breaker.record(p.breakerOpts, success, p.now())
+	openUntil := breaker.openUntil
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	switch state {
+	case circuitOpen:
+		log.Printf("Circuit opened for %s://%s until %s", upstream.Protocol, upstream.Address, openUntil.Format(time.RFC3339))
+	case circuitClosed:
+		log.Printf("Circuit closed for %s://%s", upstream.Protocol, upstream.Address)
+	}
+}
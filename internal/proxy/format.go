@@ -0,0 +1,501 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"proxygate/internal/auth"
+)
+
+// Format names the encoding of a proxy list.
+type Format string
+
+const (
+	// FormatAuto detects the format from the file extension, falling back to text.
+	FormatAuto Format = ""
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatCSV  Format = "csv"
+)
+
+// ParseFormatName validates a format name as accepted on the command line.
+func ParseFormatName(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return FormatAuto, nil
+	case "text", "txt":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	case "yaml", "yml":
+		return FormatYAML, nil
+	case "csv":
+		return FormatCSV, nil
+	default:
+		return FormatAuto, fmt.Errorf("unknown proxy list format %q", name)
+	}
+}
+
+// DetectFormat infers the format from the extension of a file path or URL path.
+func DetectFormat(location string) Format {
+	if parsed, err := url.Parse(location); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		location = parsed.Path
+	}
+
+	switch strings.ToLower(path.Ext(location)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".csv":
+		return FormatCSV
+	default:
+		return FormatText
+	}
+}
+
+// ParseFileAs reads a proxy list file in the given format; FormatAuto detects it from the extension.
+func ParseFileAs(path string, format Format, defaultCred *auth.Credentials) ([]Proxy, error) {
+	if format == FormatAuto {
+		format = DetectFormat(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open proxy list: %w", err)
+	}
+	defer file.Close()
+
+	return ParseAs(file, format, defaultCred)
+}
+
+// ParseAs reads a proxy list in the given format; FormatAuto is treated as text.
+func ParseAs(r io.Reader, format Format, defaultCred *auth.Credentials) ([]Proxy, error) {
+	var (
+		proxies []Proxy
+		err     error
+	)
+	switch format {
+	case FormatAuto, FormatText:
+		return Parse(r, defaultCred)
+	case FormatJSON:
+		proxies, err = parseJSON(r, defaultCred)
+	case FormatYAML:
+		proxies, err = parseYAML(r, defaultCred)
+	case FormatCSV:
+		proxies, err = parseCSV(r, defaultCred)
+	default:
+		return nil, fmt.Errorf("unknown proxy list format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxies loaded from list")
+	}
+
+	seen := make(duplicates)
+	unique := proxies[:0]
+	for i, proxy := range proxies {
+		if !seen.repeated(proxy, fmt.Sprintf("entry %d", i+1)) {
+			unique = append(unique, proxy)
+		}
+	}
+	return unique, nil
+}
+
+// listEntry is one proxy in a structured (JSON, YAML or CSV) list.
+type listEntry struct {
+	Protocol string            `json:"protocol" yaml:"protocol"`
+	Address  string            `json:"address" yaml:"address"`
+	Username string            `json:"username" yaml:"username"`
+	Password string            `json:"password" yaml:"password"`
+	Weight   int               `json:"weight" yaml:"weight"`
+	MaxConns int               `json:"max_conns" yaml:"max_conns"`
+	Tags     map[string]string `json:"tags" yaml:"tags"`
+	TLS      *tlsEntry         `json:"tls" yaml:"tls"`
+}
+
+type tlsEntry struct {
+	ServerName string `json:"sni" yaml:"sni"`
+	CAFile     string `json:"ca" yaml:"ca"`
+	CertFile   string `json:"cert" yaml:"cert"`
+	KeyFile    string `json:"key" yaml:"key"`
+	Insecure   bool   `json:"insecure" yaml:"insecure"`
+}
+
+var (
+	entryFields = []string{"protocol", "address", "username", "password", "weight", "max_conns", "tags", "tls"}
+	tlsFields   = []string{"sni", "ca", "cert", "key", "insecure"}
+	csvColumns  = []string{"protocol", "address", "username", "password", "weight", "max_conns", "tags", "sni", "ca", "cert", "key", "insecure"}
+)
+
+// toProxy validates the entry and converts it, applying defaultCred when it has no credentials.
+func (e listEntry) toProxy(defaultCred *auth.Credentials) (Proxy, error) {
+	if e.Address == "" {
+		return Proxy{}, errors.New("address is required")
+	}
+
+	protocol := normalizeProtocol(e.Protocol)
+	if protocol == "" {
+		protocol = ProtocolHTTP
+	}
+	if err := validateProtocol(protocol); err != nil {
+		return Proxy{}, err
+	}
+
+	host, port, err := net.SplitHostPort(e.Address)
+	if err != nil {
+		// Only a missing port is acceptable; the protocol default fills it in.
+		if strings.Contains(e.Address, ":") && !strings.HasSuffix(e.Address, "]") {
+			return Proxy{}, fmt.Errorf("invalid address %q: %w", e.Address, err)
+		}
+		host, port = strings.Trim(e.Address, "[]"), ""
+	}
+	address, err := joinHostPort(host, port, protocol)
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	if e.Weight < 0 {
+		return Proxy{}, fmt.Errorf("invalid weight %d", e.Weight)
+	}
+	if e.MaxConns < 0 {
+		return Proxy{}, fmt.Errorf("invalid max_conns %d", e.MaxConns)
+	}
+
+	var credentials *auth.Credentials
+	switch {
+	case e.Username != "":
+		credentials = &auth.Credentials{Username: e.Username, Password: e.Password}
+	case e.Password != "":
+		return Proxy{}, errors.New("password given without username")
+	default:
+		credentials = cloneCredentials(defaultCred)
+	}
+
+	var tags map[string]string
+	for key, value := range e.Tags {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" || value == "" {
+			return Proxy{}, fmt.Errorf("invalid tag %q=%q", key, value)
+		}
+		if tags == nil {
+			tags = make(map[string]string, len(e.Tags))
+		}
+		tags[key] = value
+	}
+
+	var tlsOpts *TLSOptions
+	if e.TLS != nil {
+		if protocol != "https" {
+			return Proxy{}, fmt.Errorf("tls options are only supported for https proxies, got %s", protocol)
+		}
+		tlsOpts = &TLSOptions{
+			ServerName:         e.TLS.ServerName,
+			CAFile:             e.TLS.CAFile,
+			CertFile:           e.TLS.CertFile,
+			KeyFile:            e.TLS.KeyFile,
+			InsecureSkipVerify: e.TLS.Insecure,
+		}
+		if _, err := tlsOpts.ClientConfig(""); err != nil {
+			return Proxy{}, err
+		}
+	}
+
+	return Proxy{
+		Protocol:    protocol,
+		Address:     address,
+		Credentials: credentials,
+		TLS:         tlsOpts,
+		Weight:      e.Weight,
+		MaxConns:    e.MaxConns,
+		Tags:        tags,
+	}, nil
+}
+
+// parseJSON reads a JSON array of entries, reporting errors by entry index and line.
+func parseJSON(r io.Reader, defaultCred *auth.Credentials) ([]Proxy, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy list: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy list: %w", jsonError(data, err))
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("parse proxy list: expected a JSON array of proxies")
+	}
+
+	var (
+		proxies  []Proxy
+		problems ListError
+	)
+	for index := 1; decoder.More(); index++ {
+		line := lineAt(data, skipJSONSeparators(data, decoder.InputOffset()))
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("parse proxy entry %d at line %d: %w", index, line, jsonError(data, err))
+		}
+
+		entryDecoder := json.NewDecoder(bytes.NewReader(raw))
+		entryDecoder.DisallowUnknownFields()
+		var entry listEntry
+		if err := entryDecoder.Decode(&entry); err != nil {
+			problems.add(fmt.Errorf("parse proxy entry %d at line %d: %w", index, line, err))
+			continue
+		}
+
+		proxy, err := entry.toProxy(defaultCred)
+		if err != nil {
+			problems.add(fmt.Errorf("parse proxy entry %d at line %d: %w", index, line, err))
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("parse proxy list: %w", jsonError(data, err))
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+// jsonError adds the line number to JSON syntax errors.
+func jsonError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("line %d: %w", lineAt(data, syntaxErr.Offset), err)
+	}
+	return err
+}
+
+func skipJSONSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseYAML reads a YAML sequence of entries, reporting errors by entry index and line.
+func parseYAML(r io.Reader, defaultCred *auth.Credentials) ([]Proxy, error) {
+	var document yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&document); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("parse proxy list: %w", err)
+	}
+
+	root := &document
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("parse proxy list at line %d: expected a YAML list of proxies", root.Line)
+	}
+
+	proxies := make([]Proxy, 0, len(root.Content))
+	var problems ListError
+	for i, node := range root.Content {
+		proxy, err := yamlEntry(node, defaultCred)
+		if err != nil {
+			problems.add(fmt.Errorf("parse proxy entry %d at line %d: %w", i+1, node.Line, err))
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+func yamlEntry(node *yaml.Node, defaultCred *auth.Credentials) (Proxy, error) {
+	if err := checkYAMLFields(node, entryFields); err != nil {
+		return Proxy{}, err
+	}
+
+	var entry listEntry
+	if err := node.Decode(&entry); err != nil {
+		return Proxy{}, err
+	}
+	return entry.toProxy(defaultCred)
+}
+
+// checkYAMLFields rejects unknown keys, which node.Decode would silently ignore.
+func checkYAMLFields(node *yaml.Node, known []string) error {
+	if node.Kind != yaml.MappingNode {
+		return errors.New("expected a mapping")
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if !containsString(known, key) {
+			return fmt.Errorf("line %d: unknown field %q", node.Content[i].Line, key)
+		}
+		if key == "tls" {
+			if err := checkYAMLFields(node.Content[i+1], tlsFields); err != nil {
+				return fmt.Errorf("tls: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCSV reads a CSV list with a header row naming the columns. Tags are
+// written as a single quoted "key=value,key=value" column and TLS settings
+// as the sni, ca, cert, key and insecure columns.
+func parseCSV(r io.Reader, defaultCred *auth.Credentials) ([]Proxy, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy list: %w", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !containsString(csvColumns, name) {
+			return nil, fmt.Errorf("parse proxy list at line 1: unknown column %q", header[i])
+		}
+		columns[i] = name
+	}
+	if !containsString(columns, "address") {
+		return nil, errors.New("parse proxy list at line 1: missing address column")
+	}
+
+	var (
+		proxies  []Proxy
+		problems ListError
+	)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy list: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		entry, err := csvEntry(columns, record)
+		if err == nil {
+			var proxy Proxy
+			if proxy, err = entry.toProxy(defaultCred); err == nil {
+				proxies = append(proxies, proxy)
+				continue
+			}
+		}
+		problems.add(fmt.Errorf("parse proxy at line %d: %w", line, err))
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+func csvEntry(columns, record []string) (listEntry, error) {
+	var (
+		entry listEntry
+		tls   tlsEntry
+		err   error
+	)
+	hasTLS := false
+
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		switch columns[i] {
+		case "protocol":
+			entry.Protocol = value
+		case "address":
+			entry.Address = value
+		case "username":
+			entry.Username = value
+		case "password":
+			entry.Password = value
+		case "weight":
+			if entry.Weight, err = strconv.Atoi(value); err != nil {
+				return listEntry{}, fmt.Errorf("invalid weight %q", value)
+			}
+		case "max_conns":
+			if entry.MaxConns, err = strconv.Atoi(value); err != nil {
+				return listEntry{}, fmt.Errorf("invalid max_conns %q", value)
+			}
+		case "tags":
+			if entry.Tags, err = parseTags(value); err != nil {
+				return listEntry{}, err
+			}
+		case "sni":
+			tls.ServerName, hasTLS = value, true
+		case "ca":
+			tls.CAFile, hasTLS = value, true
+		case "cert":
+			tls.CertFile, hasTLS = value, true
+		case "key":
+			tls.KeyFile, hasTLS = value, true
+		case "insecure":
+			if tls.Insecure, err = strconv.ParseBool(value); err != nil {
+				return listEntry{}, fmt.Errorf("invalid insecure value %q", value)
+			}
+			// A shared insecure column reads "false" on rows that are not https.
+			hasTLS = hasTLS || tls.Insecure
+		}
+	}
+
+	if hasTLS {
+		entry.TLS = &tls
+	}
+	return entry, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
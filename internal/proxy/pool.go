@@ -4,11 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"net"
 	"net/url"
-	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,7 +18,12 @@ import (
 )
 
 var (
-	ipPortPattern = regexp.MustCompile(`^([\d\.]+):(\d+)(?::([^:]+):([^:]+))?$`)
+	// hostPortPattern matches host:port[:user:pass] where host is a hostname,
+	// an IPv4 address or a bracketed IPv6 address.
+	hostPortPattern = regexp.MustCompile(`^(\[[^\]]+\]|[A-Za-z0-9](?:[A-Za-z0-9.\-]*[A-Za-z0-9])?):(\d+)(?::([^:]+):([^:]+))?$`)
+
+	// ErrNoMatch is returned by Select when no proxy in the pool carries the requested tags.
+	ErrNoMatch = errors.New("no proxy matches the requested tags")
 )
 
 // Proxy models a single upstream proxy server configuration.
@@ -25,6 +31,22 @@ type Proxy struct {
 	Protocol    string
 	Address     string
 	Credentials *auth.Credentials
+	// TLS configures the session to https:// upstreams; nil uses system defaults.
+	TLS *TLSOptions
+	// Weight biases weighted selection; zero counts as one.
+	Weight int
+	// MaxConns caps concurrent connections through the upstream; zero means unlimited.
+	MaxConns int
+	// Tags are free-form labels such as country or provider, with lowercase keys.
+	Tags map[string]string
+}
+
+// EffectiveWeight returns the weight used for weighted selection.
+func (p Proxy) EffectiveWeight() int {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
 }
 
 // URL returns the proxy as a URL instance.
@@ -48,36 +70,61 @@ func (p Proxy) URL() (*url.URL, error) {
 	}, nil
 }
 
+// Key identifies the upstream independently of its password.
+func (p Proxy) Key() string {
+	if p.Credentials != nil && p.Credentials.Username != "" {
+		return p.Protocol + "://" + p.Credentials.Username + "@" + p.Address
+	}
+	return p.Protocol + "://" + p.Address
+}
+
 // Pool manages upstream proxies and sticky-session mapping.
 type Pool struct {
 	mu              sync.RWMutex
 	proxies         []Proxy
-	random          *rand.Rand
-	sticky          sync.Map
+	states          map[string]*proxyState
+	selector        Selector
+	sticky          *stickyTable
 	defaultCred     *auth.Credentials
 	stickyHeaderKey string
+	breakerOpts     BreakerOptions
+	now             func() time.Time
+	onChange        []func()
 }
 
 // Options configures a Pool.
 type Options struct {
 	DefaultCredentials *auth.Credentials
 	StickyHeader       string
+	Breaker            BreakerOptions
+	// Selector chooses among available upstreams; nil selects uniformly at random.
+	Selector Selector
+	Sticky   StickyOptions
 }
 
 const defaultStickyHeader = "X-Proxy-Session"
 
 // NewPool constructs a Pool with optional defaults.
 func NewPool(opts Options) *Pool {
-	source := rand.NewSource(time.Now().UnixNano())
+	selector := opts.Selector
+	if selector == nil {
+		selector = NewRandomSelector()
+	}
 	stickyKey := opts.StickyHeader
 	if stickyKey == "" {
 		stickyKey = defaultStickyHeader
 	}
-	return &Pool{
-		random:          rand.New(source),
+	pool := &Pool{
+		states:          make(map[string]*proxyState),
+		selector:        selector,
 		defaultCred:     cloneCredentials(opts.DefaultCredentials),
 		stickyHeaderKey: stickyKey,
+		breakerOpts:     opts.Breaker,
+		now:             time.Now,
 	}
+	// The table reads the clock through the pool so tests can substitute it.
+	pool.sticky = newStickyTable(opts.Sticky, func() time.Time { return pool.now() })
+	return pool
 }
 
 // StickyHeader returns the header key used for sticky sessions.
@@ -85,11 +132,92 @@ func (p *Pool) StickyHeader() string {
 	return p.stickyHeaderKey
 }
 
-// SetProxies replaces the pool contents.
+// SetProxies atomically replaces the pool contents. Runtime state and sticky
+// sessions are kept for upstreams that are still present unchanged.
 func (p *Pool) SetProxies(proxies []Proxy) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	p.proxies = append([]Proxy(nil), proxies...)
+	p.pruneStatesLocked()
+	p.mu.Unlock()
+
+	present := make(map[string]Proxy, len(proxies))
+	for _, upstream := range proxies {
+		present[upstream.Key()] = upstream
+	}
+	p.sticky.deleteMatching(func(bound Proxy) bool {
+		current, ok := present[bound.Key()]
+		return !ok || !proxiesEqual(current, bound)
+	})
+	p.notifyChange()
+}
+
+// Add appends an upstream to the pool, failing if one with the same key is present.
+// The next reload of the pool's source replaces the contents again.
+func (p *Pool) Add(upstream Proxy) error {
+	p.mu.Lock()
+
+	if _, exists := p.findLocked(upstream.Key()); exists {
+		p.mu.Unlock()
+		return fmt.Errorf("proxy %s is already in the pool", upstream.Key())
+	}
+	p.proxies = append(p.proxies, upstream)
+	p.mu.Unlock()
+
+	p.notifyChange()
+	return nil
+}
+
+// Remove drops the upstream with the given key together with its runtime state
+// and sticky sessions. It reports whether the key was present.
+func (p *Pool) Remove(key string) bool {
+	p.mu.Lock()
+	upstream, ok := p.findLocked(key)
+	if ok {
+		remaining := make([]Proxy, 0, len(p.proxies)-1)
+		for _, candidate := range p.proxies {
+			if candidate.Key() != key {
+				remaining = append(remaining, candidate)
+			}
+		}
+		p.proxies = remaining
+		p.pruneStatesLocked()
+	}
+	p.mu.Unlock()
+
+	if ok {
+		p.evictSticky(upstream)
+		p.notifyChange()
+	}
+	return ok
+}
+
+// OnChange registers fn to run after upstreams are replaced, added or removed.
+func (p *Pool) OnChange(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onChange = append(p.onChange, fn)
+}
+
+func (p *Pool) notifyChange() {
+	p.mu.RLock()
+	listeners := append([]func(){}, p.onChange...)
+	p.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// DefaultCredentials returns the credentials applied to entries without their own.
+func (p *Pool) DefaultCredentials() *auth.Credentials {
+	return cloneCredentials(p.defaultCred)
+}
+
+// Proxies returns a snapshot of the pool contents.
+func (p *Pool) Proxies() []Proxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]Proxy(nil), p.proxies...)
 }
 
 // Len returns the number of proxies in the pool.
@@ -99,25 +227,31 @@ func (p *Pool) Len() int {
 	return len(p.proxies)
 }
 
-// Select returns a proxy, honoring sticky sessions when a key is supplied.
-func (p *Pool) Select(stickyKey string) (Proxy, error) {
+// Select returns a proxy matching the filter, honoring sticky sessions when a
+// key is supplied. A nil filter matches every proxy. The upstream is counted as
+// active from the moment it is chosen, under the same lock as the max_conns
+// check, until release is called.
+func (p *Pool) Select(stickyKey string, filter Filter) (upstream Proxy, release func(), err error) {
 	if stickyKey != "" {
-		if value, ok := p.sticky.Load(stickyKey); ok {
-			if upstream, ok := value.(Proxy); ok {
-				return upstream, nil
+		if bound, ok := p.sticky.get(stickyKey); ok {
+			if filter.Matches(bound) {
+				if release, ok := p.acquireIfAvailable(bound); ok {
+					return bound, release, nil
+				}
 			}
+			p.sticky.delete(stickyKey)
 		}
 	}
 
-	upstream, err := p.randomProxy()
+	upstream, release, err = p.pick(filter)
 	if err != nil {
-		return Proxy{}, err
+		return Proxy{}, nil, err
 	}
 
 	if stickyKey != "" {
-		p.sticky.Store(stickyKey, upstream)
+		p.sticky.set(stickyKey, upstream)
 	}
-	return upstream, nil
+	return upstream, release, nil
 }
 
 // BindSticky associates the sticky key with the provided proxy.
@@ -125,45 +259,81 @@ func (p *Pool) BindSticky(stickyKey string, upstream Proxy) {
 	if stickyKey == "" {
 		return
 	}
-	p.sticky.Store(stickyKey, upstream)
+	p.sticky.set(stickyKey, upstream)
 }
 
-// MarkFailed logs the failure and evicts matching sticky-session entries.
+// MarkFailed logs the failure, feeds the circuit breaker and evicts matching sticky-session entries.
 func (p *Pool) MarkFailed(upstream Proxy) {
 	log.Printf("Marking proxy as failed: %s://%s", upstream.Protocol, upstream.Address)
+	p.recordOutcome(upstream, false)
+	p.evictSticky(upstream)
+}
 
-	p.sticky.Range(func(key, value any) bool {
-		if v, ok := value.(Proxy); ok && proxiesEqual(v, upstream) {
-			p.sticky.Delete(key)
-		}
-		return true
+// MarkSucceeded records a successful request through the upstream.
+func (p *Pool) MarkSucceeded(upstream Proxy) {
+	p.recordOutcome(upstream, true)
+}
+
+// evictSticky removes sticky-session entries bound to the upstream.
+func (p *Pool) evictSticky(upstream Proxy) {
+	p.sticky.deleteMatching(func(bound Proxy) bool {
+		return proxiesEqual(bound, upstream)
 	})
 }
 
-func (p *Pool) randomProxy() (Proxy, error) {
+func (p *Pool) pick(filter Filter) (Proxy, func(), error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if len(p.proxies) == 0 {
-		return Proxy{}, errors.New("proxy pool is empty")
+		return Proxy{}, nil, errors.New("proxy pool is empty")
 	}
 
-	index := p.random.Intn(len(p.proxies))
-	return p.proxies[index], nil
+	candidates := p.candidatesLocked(filter)
+	if len(candidates) == 0 {
+		if len(filter) > 0 && !p.anyMatchesLocked(filter) {
+			return Proxy{}, nil, fmt.Errorf("%w: %s", ErrNoMatch, filter)
+		}
+		if len(filter) > 0 {
+			return Proxy{}, nil, fmt.Errorf("no available proxies matching %s: all are unhealthy, circuit-open or at max_conns", filter)
+		}
+		return Proxy{}, nil, errors.New("no available proxies: all upstreams are unhealthy, circuit-open or at max_conns")
+	}
+
+	chosen := candidates[p.selector.Pick(candidates)].Proxy
+	p.acquireLocked(chosen)
+	return chosen, p.activateLocked(chosen), nil
 }
 
 // LoadFromFile constructs a pool from the provided file path.
 func LoadFromFile(path string, opts Options) (*Pool, error) {
-	file, err := os.Open(path)
+	pool := NewPool(opts)
+
+	proxies, err := ParseFile(path, pool.defaultCred)
 	if err != nil {
-		return nil, fmt.Errorf("open proxy list: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	pool := NewPool(opts)
-	scanner := bufio.NewScanner(file)
+	pool.SetProxies(proxies)
+	return pool, nil
+}
+
+// ParseFile reads a proxy list file in the format implied by its extension,
+// applying defaultCred to entries without credentials.
+func ParseFile(path string, defaultCred *auth.Credentials) ([]Proxy, error) {
+	return ParseFileAs(path, FormatAuto, defaultCred)
+}
 
-	var proxies []Proxy
+// Parse reads a proxy list in text format, applying defaultCred to entries without credentials.
+// Every invalid line is reported in a single *ListError.
+func Parse(r io.Reader, defaultCred *auth.Credentials) ([]Proxy, error) {
+	scanner := bufio.NewScanner(r)
+
+	var (
+		proxies  []Proxy
+		problems ListError
+	)
+	seen := make(duplicates)
 	lineNumber := 0
 	for scanner.Scan() {
 		lineNumber++
@@ -172,9 +342,13 @@ func LoadFromFile(path string, opts Options) (*Pool, error) {
 			continue
 		}
 
-		proxy, err := parseLine(line, pool.defaultCred)
+		proxy, err := parseLine(line, defaultCred)
 		if err != nil {
-			return nil, fmt.Errorf("parse proxy at line %d: %w", lineNumber, err)
+			problems.add(fmt.Errorf("parse proxy at line %d: %w", lineNumber, err))
+			continue
+		}
+		if seen.repeated(proxy, fmt.Sprintf("line %d", lineNumber)) {
+			continue
 		}
 		proxies = append(proxies, proxy)
 	}
@@ -183,30 +357,64 @@ func LoadFromFile(path string, opts Options) (*Pool, error) {
 		return nil, fmt.Errorf("scan proxy list: %w", err)
 	}
 
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+
 	if len(proxies) == 0 {
 		return nil, errors.New("no proxies loaded from list")
 	}
 
-	pool.SetProxies(proxies)
-	return pool, nil
+	return proxies, nil
 }
 
+// parseLine parses one entry with optional trailing tags, e.g. "host:port #country=de,provider=x".
 func parseLine(line string, defaultCred *auth.Credentials) (Proxy, error) {
-	if proxy, ok := tryParseColonFormat(line, defaultCred); ok {
-		return proxy, nil
+	entry, tagList := splitTags(line)
+	entry = strings.TrimSpace(entry)
+
+	tags, err := parseTags(tagList)
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	proxy, ok, err := tryParseColonFormat(entry, defaultCred)
+	if err != nil {
+		return Proxy{}, err
+	}
+	if !ok {
+		proxy, err = parseURLFormat(entry, defaultCred)
+		if err != nil {
+			return Proxy{}, err
+		}
 	}
-	return parseURLFormat(line, defaultCred)
+	proxy.Tags = tags
+	return proxy, nil
 }
 
-func tryParseColonFormat(line string, defaultCred *auth.Credentials) (Proxy, bool) {
-	matches := ipPortPattern.FindStringSubmatch(line)
+// tryParseColonFormat parses host:port[:user:pass]. It reports false when the
+// line is not in colon format, and an error when it is but the host or port is invalid.
+func tryParseColonFormat(line string, defaultCred *auth.Credentials) (Proxy, bool, error) {
+	matches := hostPortPattern.FindStringSubmatch(line)
 	if matches == nil {
-		return Proxy{}, false
+		return Proxy{}, false, nil
+	}
+
+	host := matches[1]
+	if strings.HasPrefix(host, "[") {
+		host = strings.Trim(host, "[]")
+		ip, _, _ := strings.Cut(host, "%")
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+			return Proxy{}, true, fmt.Errorf("invalid IPv6 address %q", matches[1])
+		}
+	}
+	if err := validatePort(matches[2]); err != nil {
+		return Proxy{}, true, err
 	}
 
 	var credentials *auth.Credentials
-	switch len(matches) {
-	case 5:
+	switch {
+	case matches[3] != "":
 		credentials = &auth.Credentials{
 			Username: matches[3],
 			Password: matches[4],
@@ -219,9 +427,32 @@ func tryParseColonFormat(line string, defaultCred *auth.Credentials) (Proxy, boo
 
 	return Proxy{
 		Protocol:    "http",
-		Address:     fmt.Sprintf("%s:%s", matches[1], matches[2]),
+		Address:     net.JoinHostPort(host, matches[2]),
 		Credentials: credentials,
-	}, true
+	}, true, nil
+}
+
+// validatePort checks that port is a number between 1 and 65535.
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q: must be between 1 and 65535", port)
+	}
+	return nil
+}
+
+// duplicates remembers where each upstream was first listed.
+type duplicates map[string]string
+
+// repeated reports whether the upstream was already listed, logging a warning if so.
+func (d duplicates) repeated(upstream Proxy, position string) bool {
+	key := upstream.Key()
+	if first, ok := d[key]; ok {
+		log.Printf("Warning: skipping duplicate proxy %s at %s (first listed at %s)", key, position, first)
+		return true
+	}
+	d[key] = position
+	return false
 }
 
 func parseURLFormat(line string, defaultCred *auth.Credentials) (Proxy, error) {
@@ -230,9 +461,12 @@ func parseURLFormat(line string, defaultCred *auth.Credentials) (Proxy, error) {
 		return Proxy{}, fmt.Errorf("invalid proxy URL: %w", err)
 	}
 
-	protocol := strings.ToLower(parsedURL.Scheme)
-	if protocol == "socks" {
-		protocol = "socks5"
+	if parsedURL.Scheme == "" {
+		return Proxy{}, errors.New("expected host:port[:user:pass] or protocol://host[:port]")
+	}
+	protocol := normalizeProtocol(parsedURL.Scheme)
+	if err := validateProtocol(protocol); err != nil {
+		return Proxy{}, err
 	}
 
 	var credentials *auth.Credentials
@@ -249,14 +483,56 @@ func parseURLFormat(line string, defaultCred *auth.Credentials) (Proxy, error) {
 	if parsedURL.Host == "" {
 		return Proxy{}, errors.New("proxy url missing host")
 	}
+	address, err := joinHostPort(parsedURL.Hostname(), parsedURL.Port(), protocol)
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	query := parsedURL.Query()
+	weight := 0
+	if query.Has("weight") {
+		weight, err = strconv.Atoi(query.Get("weight"))
+		if err != nil || weight < 1 {
+			return Proxy{}, fmt.Errorf("invalid weight %q", query.Get("weight"))
+		}
+		query.Del("weight")
+	}
+	maxConns := 0
+	if query.Has("max_conns") {
+		maxConns, err = strconv.Atoi(query.Get("max_conns"))
+		if err != nil || maxConns < 1 {
+			return Proxy{}, fmt.Errorf("invalid max_conns %q", query.Get("max_conns"))
+		}
+		query.Del("max_conns")
+	}
+
+	tlsOpts, err := parseTLSQuery(query)
+	if err != nil {
+		return Proxy{}, err
+	}
+	if tlsOpts != nil && protocol != "https" {
+		return Proxy{}, fmt.Errorf("tls options are only supported for https proxies, got %s", protocol)
+	}
 
 	return Proxy{
 		Protocol:    protocol,
-		Address:     parsedURL.Host,
+		Address:     address,
 		Credentials: credentials,
+		TLS:         tlsOpts,
+		Weight:      weight,
+		MaxConns:    maxConns,
 	}, nil
 }
 
+// normalizeProtocol lowercases the scheme and maps the "socks" alias to socks5.
+func normalizeProtocol(scheme string) string {
+	protocol := strings.ToLower(strings.TrimSpace(scheme))
+	if protocol == "socks" {
+		return "socks5"
+	}
+	return protocol
+}
+
 func proxiesEqual(a, b Proxy) bool {
 	return a.Protocol == b.Protocol && a.Address == b.Address && credentialsEqual(a.Credentials, b.Credentials)
 }
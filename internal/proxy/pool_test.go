@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"proxygate/internal/auth"
 )
@@ -58,23 +62,762 @@ func TestSelectStickyReusesProxy(t *testing.T) {
 		{Protocol: "http", Address: "two"},
 	})
 
-	first, err := pool.Select("session-1")
+	first, _, err := pool.Select("session-1", nil)
 	if err != nil {
 		t.Fatalf("Select returned error: %v", err)
 	}
 
-	second, err := pool.Select("session-1")
+	second, _, err := pool.Select("session-1", nil)
 	if err != nil {
 		t.Fatalf("Select returned error: %v", err)
 	}
 
-	if first != second {
+	if !proxiesEqual(first, second) {
 		t.Fatalf("expected sticky selection to reuse proxy, got %+v vs %+v", first, second)
 	}
 
 	pool.MarkFailed(first)
 
-	if value, ok := pool.sticky.Load("session-1"); ok && value.(Proxy) == first {
+	if value, ok := pool.sticky.get("session-1"); ok && proxiesEqual(value, first) {
 		t.Fatalf("expected sticky entry to be cleared after failure")
 	}
 }
+
+func TestParseLineTLSOptions(t *testing.T) {
+	upstream, err := parseLine("https://proxy.example.com:8443?sni=edge.example.com&insecure=true", nil)
+	if err != nil {
+		t.Fatalf("parseLine returned error: %v", err)
+	}
+	if upstream.TLS == nil || upstream.TLS.ServerName != "edge.example.com" || !upstream.TLS.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS options: %+v", upstream.TLS)
+	}
+
+	invalid := []string{
+		"http://proxy.example.com:8080?sni=edge.example.com",
+		"https://proxy.example.com:8443?unknown=1",
+		"https://proxy.example.com:8443?cert=/tmp/only-cert.pem",
+		"https://proxy.example.com:8443?ca=/does/not/exist.pem",
+	}
+	for _, line := range invalid {
+		if _, err := parseLine(line, nil); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	opts := DefaultBreakerOptions()
+	opts.FailureThreshold = 2
+	opts.Cooldown = time.Minute
+
+	pool := NewPool(Options{Breaker: opts})
+	pool.now = func() time.Time { return now }
+
+	flaky := Proxy{Protocol: "http", Address: "flaky:1"}
+	steady := Proxy{Protocol: "http", Address: "steady:1"}
+	pool.SetProxies([]Proxy{flaky, steady})
+
+	pool.MarkFailed(flaky)
+	if !pool.Available(flaky) {
+		t.Fatalf("expected circuit to stay closed below threshold")
+	}
+	pool.MarkFailed(flaky)
+	if pool.Available(flaky) {
+		t.Fatalf("expected circuit to open after consecutive failures")
+	}
+
+	for i := 0; i < 20; i++ {
+		selected, _, err := pool.Select("", nil)
+		if err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+		if proxiesEqual(selected, flaky) {
+			t.Fatalf("expected open circuit to be excluded from selection")
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if !pool.Available(flaky) {
+		t.Fatalf("expected half-open circuit after cooldown")
+	}
+
+	// The half-open trial fails: the circuit re-opens with a doubled cooldown.
+	pool.MarkFailed(flaky)
+	now = now.Add(time.Minute)
+	if pool.Available(flaky) {
+		t.Fatalf("expected exponential backoff to keep circuit open")
+	}
+	now = now.Add(time.Minute)
+	if !pool.Available(flaky) {
+		t.Fatalf("expected half-open circuit after doubled cooldown")
+	}
+
+	pool.MarkSucceeded(flaky)
+	pool.mu.Lock()
+	state := pool.states[flaky.Key()].breaker.state
+	pool.mu.Unlock()
+	if state != circuitClosed {
+		t.Fatalf("expected successful trial to close circuit, got %s", state)
+	}
+}
+
+func TestStickySelectionCountsHalfOpenTrials(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	opts := DefaultBreakerOptions()
+	opts.FailureThreshold = 1
+	opts.Cooldown = time.Minute
+	opts.HalfOpenTrials = 1
+
+	pool := NewPool(Options{Breaker: opts})
+	pool.now = func() time.Time { return now }
+
+	flaky := Proxy{Protocol: "http", Address: "flaky:1"}
+	steady := Proxy{Protocol: "http", Address: "steady:1"}
+	pool.SetProxies([]Proxy{flaky, steady})
+
+	pool.MarkFailed(flaky)
+	now = now.Add(time.Minute)
+	pool.BindSticky("session", flaky)
+
+	selected, _, err := pool.Select("session", nil)
+	if err != nil {
+		t.Fatalf("Select returned error: %v", err)
+	}
+	if !proxiesEqual(selected, flaky) {
+		t.Fatalf("expected the sticky session to get the half-open trial, got %s", selected.Address)
+	}
+	for i := 0; i < 5; i++ {
+		selected, _, err := pool.Select("session", nil)
+		if err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+		if proxiesEqual(selected, flaky) {
+			t.Fatalf("expected only %d half-open trial, sticky selection %d got it too", opts.HalfOpenTrials, i+2)
+		}
+	}
+}
+
+func TestCircuitBreakerBackoff(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cooldowns := func(opts BreakerOptions, opens int) []time.Duration {
+		var b circuitBreaker
+		got := make([]time.Duration, 0, opens)
+		for i := 0; i < opens; i++ {
+			b.trip(opts, now)
+			got = append(got, b.openUntil.Sub(now))
+		}
+		return got
+	}
+
+	got := cooldowns(BreakerOptions{FailureThreshold: 1, Cooldown: time.Second}, 4)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if got[i] != want {
+			t.Fatalf("uncapped: expected cooldowns to double without MaxCooldown, got %v", got)
+		}
+	}
+	if last := cooldowns(BreakerOptions{FailureThreshold: 1, Cooldown: time.Second}, 80)[79]; last <= 0 {
+		t.Fatalf("uncapped: expected the cooldown to stay positive after many re-opens, got %s", last)
+	}
+
+	got = cooldowns(DefaultBreakerOptions(), 7)
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute} {
+		if got[i] != want {
+			t.Fatalf("defaults: expected cooldowns to double up to MaxCooldown, got %v", got)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	candidates := []Candidate{
+		{Proxy: Proxy{Address: "a", Weight: 1}, ActiveConns: 4, Latency: 80 * time.Millisecond},
+		{Proxy: Proxy{Address: "b", Weight: 0}, ActiveConns: 1, Latency: 20 * time.Millisecond},
+		{Proxy: Proxy{Address: "c", Weight: 8}, ActiveConns: 2, Latency: 40 * time.Millisecond},
+	}
+
+	roundRobin := &RoundRobinSelector{}
+	for i := 0; i < 6; i++ {
+		if got := roundRobin.Pick(candidates); got != i%3 {
+			t.Fatalf("round-robin pick %d: expected %d, got %d", i, i%3, got)
+		}
+	}
+
+	if got := (LeastConnSelector{}).Pick(candidates); got != 1 {
+		t.Fatalf("least-conn: expected index 1, got %d", got)
+	}
+
+	if got := (&LowestLatencySelector{}).Pick(candidates); got != 1 {
+		t.Fatalf("latency: expected index 1, got %d", got)
+	}
+
+	unmeasured := append([]Candidate(nil), candidates...)
+	unmeasured[2].Latency = 0
+	if got := (&LowestLatencySelector{}).Pick(unmeasured); got != 2 {
+		t.Fatalf("latency: expected unmeasured upstream to be explored, got %d", got)
+	}
+
+	fresh := []Candidate{
+		{Proxy: Proxy{Address: "a"}},
+		{Proxy: Proxy{Address: "b"}, Latency: 10 * time.Millisecond},
+		{Proxy: Proxy{Address: "c"}},
+		{Proxy: Proxy{Address: "d"}},
+	}
+	latency := &LowestLatencySelector{}
+	picked := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		picked[latency.Pick(fresh)]++
+	}
+	if picked[0] != 2 || picked[2] != 2 || picked[3] != 2 {
+		t.Fatalf("latency: expected picks to rotate over unmeasured upstreams, got %v", picked)
+	}
+
+	weighted := NewWeightedRandomSelector()
+	counts := make([]int, len(candidates))
+	for i := 0; i < 2000; i++ {
+		counts[weighted.Pick(candidates)]++
+	}
+	if counts[2] < counts[0]*3 || counts[2] < counts[1]*3 {
+		t.Fatalf("weighted: expected heavy upstream to dominate, got %v", counts)
+	}
+
+	if _, err := NewSelector("fastest"); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestPoolTracksActiveConnections(t *testing.T) {
+	pool := NewPool(Options{Selector: LeastConnSelector{}})
+	busy := Proxy{Protocol: "http", Address: "busy:1"}
+	idle := Proxy{Protocol: "http", Address: "idle:1"}
+	pool.SetProxies([]Proxy{busy, idle})
+
+	release := pool.Acquire(busy)
+	selected, _, err := pool.Select("", nil)
+	if err != nil {
+		t.Fatalf("Select returned error: %v", err)
+	}
+	if !proxiesEqual(selected, idle) {
+		t.Fatalf("expected least-active upstream, got %+v", selected)
+	}
+
+	release()
+	release()
+	pool.mu.Lock()
+	active := pool.states[busy.Key()].active
+	pool.mu.Unlock()
+	if active != 0 {
+		t.Fatalf("expected release to be idempotent, got %d active", active)
+	}
+}
+
+func TestStickySessionsExpireAndEvict(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	pool := NewPool(Options{Sticky: StickyOptions{
+		IdleTTL:     time.Minute,
+		MaxTTL:      time.Hour,
+		MaxSessions: 2,
+	}})
+	pool.now = func() time.Time { return now }
+	pool.SetProxies([]Proxy{{Protocol: "http", Address: "one"}})
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, _, err := pool.Select(key, nil); err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+	}
+	if _, ok := pool.sticky.get("a"); ok {
+		t.Fatalf("expected least recently used session to be evicted")
+	}
+	if pool.sticky.len() != 2 {
+		t.Fatalf("expected table capped at 2 sessions, got %d", pool.sticky.len())
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, ok := pool.sticky.get("b"); !ok {
+		t.Fatalf("expected session b to still be live")
+	}
+
+	now = now.Add(45 * time.Second)
+	if removed := pool.sticky.sweep(); removed != 1 {
+		t.Fatalf("expected idle session c to be swept, removed %d", removed)
+	}
+
+	for i := 0; i < 60; i++ {
+		now = now.Add(50 * time.Second)
+		pool.sticky.get("b")
+	}
+	if _, ok := pool.sticky.get("b"); ok {
+		t.Fatalf("expected session b to hit its absolute TTL despite activity")
+	}
+}
+
+func TestParseLineTags(t *testing.T) {
+	tests := []struct {
+		line     string
+		address  string
+		password string
+		tags     map[string]string
+		wantErr  bool
+	}{
+		{line: "10.0.0.1:8080 #country=de,provider=x", address: "10.0.0.1:8080", tags: map[string]string{"country": "de", "provider": "x"}},
+		{line: "10.0.0.1:8080:user:pass#Country=DE", address: "10.0.0.1:8080", tags: map[string]string{"country": "DE"}},
+		{line: "socks5://proxy.example.com:1080 # asn=3320 , type=residential", address: "proxy.example.com:1080", tags: map[string]string{"asn": "3320", "type": "residential"}},
+		{line: "http://proxy.example.com:3128", address: "proxy.example.com:3128"},
+		{line: "10.0.0.1:8080:user:p#ss", address: "10.0.0.1:8080", password: "p#ss"},
+		{line: "10.0.0.1:8080:user:p#ss #country=de", address: "10.0.0.1:8080", password: "p#ss", tags: map[string]string{"country": "de"}},
+		{line: "10.0.0.1:8080:user:a#b=c#country=de", address: "10.0.0.1:8080", password: "a#b=c", tags: map[string]string{"country": "de"}},
+		{line: "10.0.0.1:8080:user:a#b=c #", address: "10.0.0.1:8080", password: "a#b=c"},
+		{line: "10.0.0.1:8080 #country", wantErr: true},
+		{line: "10.0.0.1:8080 #country=de,country=fr", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			upstream, err := parseLine(tt.line, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", upstream)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine returned error: %v", err)
+			}
+			if upstream.Address != tt.address {
+				t.Fatalf("expected address %s, got %s", tt.address, upstream.Address)
+			}
+			if tt.password != "" && (upstream.Credentials == nil || upstream.Credentials.Password != tt.password) {
+				t.Fatalf("expected password %q, got %+v", tt.password, upstream.Credentials)
+			}
+			if len(upstream.Tags) != len(tt.tags) {
+				t.Fatalf("expected tags %v, got %v", tt.tags, upstream.Tags)
+			}
+			for key, value := range tt.tags {
+				if upstream.Tags[key] != value {
+					t.Fatalf("expected tags %v, got %v", tt.tags, upstream.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectFiltersByTags(t *testing.T) {
+	german := Proxy{Protocol: "http", Address: "de", Tags: map[string]string{"country": "de"}}
+	french := Proxy{Protocol: "http", Address: "fr", Tags: map[string]string{"country": "fr"}}
+	pool := NewPool(Options{})
+	pool.SetProxies([]Proxy{german, french})
+
+	for i := 0; i < 20; i++ {
+		selected, _, err := pool.Select("", Filter{"country": "DE"})
+		if err != nil {
+			t.Fatalf("Select returned error: %v", err)
+		}
+		if !proxiesEqual(selected, german) {
+			t.Fatalf("expected only the country=de proxy, got %+v", selected)
+		}
+	}
+
+	pool.BindSticky("session", french)
+	selected, _, err := pool.Select("session", Filter{"country": "de"})
+	if err != nil || !proxiesEqual(selected, german) {
+		t.Fatalf("expected sticky binding outside the filter to be replaced, got %+v (%v)", selected, err)
+	}
+
+	if _, _, err := pool.Select("", Filter{"country": "us"}); !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected ErrNoMatch, got %v", err)
+	}
+
+	pool.SetHealthy(german, false)
+	_, _, err = pool.Select("", Filter{"country": "de"})
+	if err == nil || errors.Is(err, ErrNoMatch) {
+		t.Fatalf("expected unavailable-proxies error for unhealthy match, got %v", err)
+	}
+}
+
+func TestParseStructuredFormats(t *testing.T) {
+	defaultCred := &auth.Credentials{Username: "global", Password: "pw"}
+
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			content: `[
+  {"protocol": "socks5", "address": "10.0.0.1:1080", "username": "alice", "password": "secret",
+   "weight": 3, "max_conns": 10, "tags": {"Country": "de", "provider": "x"}},
+  {"protocol": "https", "address": "proxy.example.com:8443", "tls": {"sni": "edge.example.com", "insecure": true}}
+]`,
+		},
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			content: `- protocol: socks5
+  address: 10.0.0.1:1080
+  username: alice
+  password: secret
+  weight: 3
+  max_conns: 10
+  tags:
+    Country: de
+    provider: x
+- protocol: https
+  address: proxy.example.com:8443
+  tls:
+    sni: edge.example.com
+    insecure: true
+`,
+		},
+		{
+			name:   "csv",
+			format: FormatCSV,
+			content: `protocol,address,username,password,weight,max_conns,tags,sni,insecure
+socks5,10.0.0.1:1080,alice,secret,3,10,"Country=de,provider=x",,
+# comment rows are skipped
+https,proxy.example.com:8443,,,,,,edge.example.com,true
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := ParseAs(strings.NewReader(tt.content), tt.format, defaultCred)
+			if err != nil {
+				t.Fatalf("ParseAs returned error: %v", err)
+			}
+			if len(proxies) != 2 {
+				t.Fatalf("expected 2 proxies, got %d", len(proxies))
+			}
+
+			first := proxies[0]
+			if first.Protocol != "socks5" || first.Address != "10.0.0.1:1080" || first.Weight != 3 || first.MaxConns != 10 {
+				t.Fatalf("unexpected first proxy: %+v", first)
+			}
+			if first.Credentials == nil || first.Credentials.Username != "alice" || first.Credentials.Password != "secret" {
+				t.Fatalf("unexpected first credentials: %+v", first.Credentials)
+			}
+			if first.Tags["country"] != "de" || first.Tags["provider"] != "x" {
+				t.Fatalf("unexpected first tags: %v", first.Tags)
+			}
+
+			second := proxies[1]
+			if second.Credentials == nil || second.Credentials.Username != "global" {
+				t.Fatalf("expected default credentials on second proxy, got %+v", second.Credentials)
+			}
+			if second.TLS == nil || second.TLS.ServerName != "edge.example.com" || !second.TLS.InsecureSkipVerify {
+				t.Fatalf("unexpected second TLS options: %+v", second.TLS)
+			}
+		})
+	}
+}
+
+func TestParseStructuredFormatsReportPosition(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		content string
+		want    string
+	}{
+		{
+			name:    "json unknown field",
+			format:  FormatJSON,
+			content: "[\n  {\"address\": \"a:1\"},\n  {\"address\": \"b:1\", \"port\": 2}\n]",
+			want:    "entry 2 at line 3",
+		},
+		{
+			name:    "json syntax",
+			format:  FormatJSON,
+			content: "[\n  {\"address\": \"a:1\"},\n  {\"address\": }\n]",
+			want:    "line 3",
+		},
+		{
+			name:    "yaml missing address",
+			format:  FormatYAML,
+			content: "- address: a:1\n- protocol: http\n",
+			want:    "entry 2 at line 2",
+		},
+		{
+			name:    "yaml unknown tls field",
+			format:  FormatYAML,
+			content: "- address: a:1\n  protocol: https\n  tls:\n    server: x\n",
+			want:    "line 4",
+		},
+		{
+			name:    "csv bad weight",
+			format:  FormatCSV,
+			content: "address,weight\na:1,2\nb:1,heavy\n",
+			want:    "line 3",
+		},
+		{
+			name:    "csv unknown column",
+			format:  FormatCSV,
+			content: "address,port\na:1,2\n",
+			want:    "unknown column",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAs(strings.NewReader(tt.content), tt.format, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestParseCSVIgnoresUnsetTLSColumns(t *testing.T) {
+	content := `protocol,address,sni,insecure
+http,10.0.0.1:8080,,false
+https,proxy.example.com:8443,,true
+`
+	proxies, err := ParseAs(strings.NewReader(content), FormatCSV, nil)
+	if err != nil {
+		t.Fatalf("ParseAs returned error: %v", err)
+	}
+	if len(proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(proxies))
+	}
+	if proxies[0].TLS != nil {
+		t.Fatalf("expected no TLS options on the http row, got %+v", proxies[0].TLS)
+	}
+	if proxies[1].TLS == nil || !proxies[1].TLS.InsecureSkipVerify {
+		t.Fatalf("expected insecure TLS options on the https row, got %+v", proxies[1].TLS)
+	}
+
+	if _, err := ParseAs(strings.NewReader("protocol,address,insecure\nhttp,10.0.0.1:8080,true\n"), FormatCSV, nil); err == nil {
+		t.Fatalf("expected insecure=true on an http row to be rejected")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := map[string]Format{
+		"proxies.json":                        FormatJSON,
+		"/etc/proxies.YAML":                   FormatYAML,
+		"list.yml":                            FormatYAML,
+		"list.csv":                            FormatCSV,
+		"proxy_list.txt":                      FormatText,
+		"https://lists.example.com/dc.json?x": FormatJSON,
+		"https://lists.example.com/dc":        FormatText,
+	}
+	for location, want := range tests {
+		if got := DetectFormat(location); got != want {
+			t.Fatalf("DetectFormat(%q) = %q, want %q", location, got, want)
+		}
+	}
+}
+
+func TestSelectRespectsMaxConns(t *testing.T) {
+	limited := Proxy{Protocol: "http", Address: "limited", MaxConns: 1}
+	pool := NewPool(Options{})
+	pool.SetProxies([]Proxy{limited})
+
+	_, release, err := pool.Select("", nil)
+	if err != nil {
+		t.Fatalf("Select returned error: %v", err)
+	}
+
+	if _, _, err := pool.Select("", nil); err == nil {
+		t.Fatalf("expected selection to fail while the proxy is at max_conns")
+	}
+
+	release()
+	if _, _, err := pool.Select("", nil); err != nil {
+		t.Fatalf("expected selection after release, got %v", err)
+	}
+}
+
+func TestConcurrentSelectHoldsMaxConns(t *testing.T) {
+	proxies, err := ParseAs(strings.NewReader(`[{"protocol": "http", "address": "limited:1", "max_conns": 2}]`), FormatJSON, nil)
+	if err != nil {
+		t.Fatalf("ParseAs returned error: %v", err)
+	}
+	limited := proxies[0]
+	pool := NewPool(Options{})
+	pool.SetProxies(proxies)
+
+	const callers = 16
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		selected int
+	)
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			// Half of the callers use a sticky session already bound to the upstream.
+			key := ""
+			if i%2 == 0 {
+				key = "session"
+			}
+			if _, _, err := pool.Select(key, nil); err == nil {
+				mu.Lock()
+				selected++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	pool.BindSticky("session", limited)
+	close(start)
+	wg.Wait()
+
+	if selected != limited.MaxConns {
+		t.Fatalf("expected exactly %d concurrent selections, got %d", limited.MaxConns, selected)
+	}
+	if active := pool.Stats()[0].ActiveConns; active != limited.MaxConns {
+		t.Fatalf("expected %d active connections, got %d", limited.MaxConns, active)
+	}
+}
+
+func TestConcurrentSelectSpreadsLeastConn(t *testing.T) {
+	pool := NewPool(Options{Selector: LeastConnSelector{}})
+	pool.SetProxies([]Proxy{{Protocol: "http", Address: "a:1"}, {Protocol: "http", Address: "b:1"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := pool.Select("", nil); err != nil {
+				t.Errorf("Select returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, stats := range pool.Stats() {
+		if stats.ActiveConns != 4 {
+			t.Fatalf("expected concurrent selections to spread evenly, got %+v", pool.Stats())
+		}
+	}
+}
+
+func TestParseLineColonFormat(t *testing.T) {
+	tests := []struct {
+		line     string
+		address  string
+		username string
+		wantErr  bool
+	}{
+		{line: "127.0.0.1:8080", address: "127.0.0.1:8080"},
+		{line: "127.0.0.1:8080:alice:secret", address: "127.0.0.1:8080", username: "alice"},
+		{line: "proxy.example.com:3128", address: "proxy.example.com:3128"},
+		{line: "proxy-1.example.com:3128:bob:pw", address: "proxy-1.example.com:3128", username: "bob"},
+		{line: "localhost:1", address: "localhost:1"},
+		{line: "[2001:db8::1]:8080", address: "[2001:db8::1]:8080"},
+		{line: "[2001:db8::1]:8080:user:pass", address: "[2001:db8::1]:8080", username: "user"},
+		{line: "[fe80::1%eth0]:65535", address: "[fe80::1%eth0]:65535"},
+		{line: "127.0.0.1:0", wantErr: true},
+		{line: "127.0.0.1:65536", wantErr: true},
+		{line: "proxy.example.com:99999:user:pass", wantErr: true},
+		{line: "[not-an-ip]:8080", wantErr: true},
+		{line: "[10.0.0.1]:8080", wantErr: true},
+		{line: "2001:db8::1:8080", wantErr: true},
+		{line: "http://proxy.example.com:0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			upstream, err := parseLine(tt.line, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", upstream)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine returned error: %v", err)
+			}
+			if upstream.Protocol != "http" || upstream.Address != tt.address {
+				t.Fatalf("expected http://%s, got %s://%s", tt.address, upstream.Protocol, upstream.Address)
+			}
+			switch {
+			case tt.username == "" && upstream.Credentials != nil:
+				t.Fatalf("expected no credentials, got %+v", upstream.Credentials)
+			case tt.username != "" && (upstream.Credentials == nil || upstream.Credentials.Username != tt.username):
+				t.Fatalf("expected username %s, got %+v", tt.username, upstream.Credentials)
+			}
+		})
+	}
+}
+
+func TestParseSkipsDuplicates(t *testing.T) {
+	content := `10.0.0.1:8080
+proxy.example.com:3128
+http://10.0.0.1:8080
+10.0.0.1:8080:alice:secret
+`
+	proxies, err := Parse(strings.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	want := []string{"http://10.0.0.1:8080", "http://proxy.example.com:3128", "http://alice@10.0.0.1:8080"}
+	if len(proxies) != len(want) {
+		t.Fatalf("expected %d proxies, got %d: %+v", len(want), len(proxies), proxies)
+	}
+	for i, key := range want {
+		if proxies[i].Key() != key {
+			t.Fatalf("expected proxy %d to be %s, got %s", i, key, proxies[i].Key())
+		}
+	}
+}
+
+func TestParseReportsAllInvalidLines(t *testing.T) {
+	content := `10.0.0.1:8080
+ftp://files.example.com:21
+htpp://proxy.example.com:3128
+# comment
+socks5://proxy.example.com
+10.0.0.2:70000
+not a proxy
+`
+	_, err := Parse(strings.NewReader(content), nil)
+
+	var listErr *ListError
+	if !errors.As(err, &listErr) {
+		t.Fatalf("expected *ListError, got %v", err)
+	}
+	if len(listErr.Problems) != 4 {
+		t.Fatalf("expected 4 problems, got %d: %v", len(listErr.Problems), err)
+	}
+	for _, want := range []string{
+		`line 2: unsupported protocol "ftp"`,
+		`line 3: unsupported protocol "htpp"`,
+		`line 6: invalid port "70000"`,
+		`line 7: `,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected report to contain %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestParseFillsDefaultPorts(t *testing.T) {
+	tests := map[string]string{
+		"http://proxy.example.com":    "proxy.example.com:80",
+		"https://proxy.example.com":   "proxy.example.com:443",
+		"socks://proxy.example.com":   "proxy.example.com:1080",
+		"socks4a://proxy.example.com": "proxy.example.com:1080",
+		"socks5://[2001:db8::1]":      "[2001:db8::1]:1080",
+	}
+	for line, want := range tests {
+		upstream, err := parseLine(line, nil)
+		if err != nil {
+			t.Fatalf("parseLine(%q) returned error: %v", line, err)
+		}
+		if upstream.Address != want {
+			t.Fatalf("parseLine(%q) address = %s, want %s", line, upstream.Address, want)
+		}
+	}
+
+	proxies, err := ParseAs(strings.NewReader(`[{"protocol": "https", "address": "proxy.example.com"}]`), FormatJSON, nil)
+	if err != nil || proxies[0].Address != "proxy.example.com:443" {
+		t.Fatalf("expected default port for structured entry, got %+v (%v)", proxies, err)
+	}
+}
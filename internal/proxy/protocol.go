@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Upstream protocols with a dial strategy in the dialer package.
+const (
+	ProtocolHTTP    = "http"
+	ProtocolHTTPS   = "https"
+	ProtocolSOCKS4  = "socks4"
+	ProtocolSOCKS4A = "socks4a"
+	ProtocolSOCKS5  = "socks5"
+)
+
+var protocols = []string{ProtocolHTTP, ProtocolHTTPS, ProtocolSOCKS4, ProtocolSOCKS4A, ProtocolSOCKS5}
+
+// Protocols returns the protocols accepted in proxy lists.
+func Protocols() []string {
+	return append([]string(nil), protocols...)
+}
+
+// DefaultPort returns the port assumed for entries that omit one, or "" for unknown protocols.
+func DefaultPort(protocol string) string {
+	switch protocol {
+	case ProtocolHTTP:
+		return "80"
+	case ProtocolHTTPS:
+		return "443"
+	case ProtocolSOCKS4, ProtocolSOCKS4A, ProtocolSOCKS5:
+		return "1080"
+	default:
+		return ""
+	}
+}
+
+// validateProtocol rejects protocols that no dialer implements.
+func validateProtocol(protocol string) error {
+	for _, supported := range protocols {
+		if protocol == supported {
+			return nil
+		}
+	}
+	if protocol == "" {
+		return fmt.Errorf("missing protocol (supported: %s)", strings.Join(protocols, ", "))
+	}
+	return fmt.Errorf("unsupported protocol %q (supported: %s)", protocol, strings.Join(protocols, ", "))
+}
+
+// joinHostPort validates host and port, filling in the protocol's default port when port is empty.
+func joinHostPort(host, port, protocol string) (string, error) {
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if port == "" {
+		port = DefaultPort(protocol)
+	}
+	if err := validatePort(port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ListError reports every invalid entry found in a proxy list, so a bad list
+// can be fixed in one pass instead of one error at a time.
+type ListError struct {
+	Problems []error
+}
+
+func (e *ListError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Error()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid proxy entries:", len(e.Problems))
+	for _, problem := range e.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the individual problems.
+func (e *ListError) Unwrap() []error {
+	return e.Problems
+}
+
+func (e *ListError) add(err error) {
+	e.Problems = append(e.Problems, err)
+}
+
+// err returns the ListError, or nil when no problems were recorded.
+func (e *ListError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
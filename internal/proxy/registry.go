@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Registry holds named pools and the default used when a request names none.
+type Registry struct {
+	mu          sync.RWMutex
+	pools       map[string]*Pool
+	defaultName string
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{pools: make(map[string]*Pool)}
+}
+
+// Add registers a pool under name. The first pool added becomes the default.
+func (r *Registry) Add(name string, pool *Pool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("pool name cannot be empty")
+	}
+	if _, exists := r.pools[name]; exists {
+		return fmt.Errorf("pool %q already registered", name)
+	}
+
+	r.pools[name] = pool
+	if r.defaultName == "" {
+		r.defaultName = name
+	}
+	return nil
+}
+
+// SetDefault selects the pool used when a request does not name one.
+func (r *Registry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pools[name]; !ok {
+		return fmt.Errorf("unknown pool %q", name)
+	}
+	r.defaultName = name
+	return nil
+}
+
+// Get returns the named pool, or the default pool when name is empty.
+func (r *Registry) Get(name string) (*Pool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	pool, ok := r.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pool %q", name)
+	}
+	return pool, nil
+}
+
+// DefaultName returns the name of the default pool.
+func (r *Registry) DefaultName() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.defaultName
+}
+
+// Names returns the registered pool names in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.pools))
+	for name := range r.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
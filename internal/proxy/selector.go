@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Selection strategy names accepted by NewSelector.
+const (
+	StrategyRandom         = "random"
+	StrategyRoundRobin     = "round-robin"
+	StrategyWeightedRandom = "weighted"
+	StrategyLeastConn      = "least-conn"
+	StrategyLowestLatency  = "latency"
+)
+
+// Candidate is an upstream eligible for selection, with its runtime statistics.
+type Candidate struct {
+	Proxy Proxy
+	// ActiveConns is the number of in-flight tunnels and requests through the upstream.
+	ActiveConns int
+	// Latency is the EWMA of successful dial latency; zero when not yet measured.
+	Latency time.Duration
+}
+
+// Selector picks one of the candidates and returns its index.
+// Candidates are never empty, and implementations must be safe for concurrent use.
+type Selector interface {
+	Pick(candidates []Candidate) int
+}
+
+// NewSelector returns the built-in selector for the strategy name.
+func NewSelector(strategy string) (Selector, error) {
+	switch strategy {
+	case "", StrategyRandom:
+		return NewRandomSelector(), nil
+	case StrategyRoundRobin:
+		return &RoundRobinSelector{}, nil
+	case StrategyWeightedRandom:
+		return NewWeightedRandomSelector(), nil
+	case StrategyLeastConn:
+		return LeastConnSelector{}, nil
+	case StrategyLowestLatency:
+		return &LowestLatencySelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection strategy %q", strategy)
+	}
+}
+
+// RandomSelector picks uniformly at random.
+type RandomSelector struct {
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewRandomSelector returns a RandomSelector seeded from the clock.
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Pick implements Selector.
+func (s *RandomSelector) Pick(candidates []Candidate) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.random.Intn(len(candidates))
+}
+
+// RoundRobinSelector cycles through the candidates in order.
+type RoundRobinSelector struct {
+	next atomic.Uint64
+}
+
+// Pick implements Selector.
+func (s *RoundRobinSelector) Pick(candidates []Candidate) int {
+	return int((s.next.Add(1) - 1) % uint64(len(candidates)))
+}
+
+// WeightedRandomSelector picks at random proportionally to Proxy.Weight.
+type WeightedRandomSelector struct {
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewWeightedRandomSelector returns a WeightedRandomSelector seeded from the clock.
+func NewWeightedRandomSelector() *WeightedRandomSelector {
+	return &WeightedRandomSelector{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Pick implements Selector.
+func (s *WeightedRandomSelector) Pick(candidates []Candidate) int {
+	total := 0
+	for _, candidate := range candidates {
+		total += candidate.Proxy.EffectiveWeight()
+	}
+
+	s.mu.Lock()
+	point := s.random.Intn(total)
+	s.mu.Unlock()
+
+	for i, candidate := range candidates {
+		point -= candidate.Proxy.EffectiveWeight()
+		if point < 0 {
+			return i
+		}
+	}
+	return len(candidates) - 1
+}
+
+// LeastConnSelector picks the upstream with the fewest active connections.
+type LeastConnSelector struct{}
+
+// Pick implements Selector.
+func (LeastConnSelector) Pick(candidates []Candidate) int {
+	best := 0
+	for i, candidate := range candidates {
+		if candidate.ActiveConns < candidates[best].ActiveConns {
+			best = i
+		}
+	}
+	return best
+}
+
+// LowestLatencySelector picks the upstream with the lowest latency EWMA.
+// Unmeasured upstreams are tried first, in rotation, so that concurrent
+// requests spread across them and every upstream gets a measurement.
+type LowestLatencySelector struct {
+	next atomic.Uint64
+}
+
+// Pick implements Selector.
+func (s *LowestLatencySelector) Pick(candidates []Candidate) int {
+	var unmeasured []int
+	best := 0
+	for i, candidate := range candidates {
+		if candidate.Latency == 0 {
+			unmeasured = append(unmeasured, i)
+			continue
+		}
+		if candidates[best].Latency == 0 || candidate.Latency < candidates[best].Latency {
+			best = i
+		}
+	}
+	if len(unmeasured) > 0 {
+		return unmeasured[(s.next.Add(1)-1)%uint64(len(unmeasured))]
+	}
+	return best
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// proxyState tracks runtime status for a single upstream.
+type proxyState struct {
+	unhealthy bool
+	// disabled is set by operators and, unlike unhealthy, is never cleared by health checks.
+	disabled bool
+	breaker  circuitBreaker
+	active   int
+	latency  time.Duration
+}
+
+// latencyAlpha weights the newest sample in the latency EWMA.
+const latencyAlpha = 0.3
+
+// SetHealthy records the outcome of active health checking for the upstream.
+// Unhealthy upstreams are excluded from selection until marked healthy again.
+func (p *Pool) SetHealthy(upstream Proxy, healthy bool) {
+	p.mu.Lock()
+	state := p.stateLocked(upstream)
+	changed := state.unhealthy == healthy
+	state.unhealthy = !healthy
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if healthy {
+		log.Printf("Proxy recovered: %s://%s", upstream.Protocol, upstream.Address)
+		return
+	}
+	log.Printf("Proxy marked unhealthy: %s://%s", upstream.Protocol, upstream.Address)
+	p.evictSticky(upstream)
+}
+
+// Healthy reports whether the upstream passed its most recent health evaluation.
+func (p *Pool) Healthy(upstream Proxy) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	state, ok := p.states[upstream.Key()]
+	return !ok || !state.unhealthy
+}
+
+// Available reports whether the upstream may currently be selected.
+func (p *Pool) Available(upstream Proxy) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.isAvailableLocked(upstream)
+}
+
+// isAvailableLocked requires the write lock because it may move an open circuit to half-open.
+func (p *Pool) isAvailableLocked(upstream Proxy) bool {
+	state, ok := p.states[upstream.Key()]
+	if !ok {
+		return true
+	}
+	if state.unhealthy || state.disabled {
+		return false
+	}
+	if upstream.MaxConns > 0 && state.active >= upstream.MaxConns {
+		return false
+	}
+	return !p.breakerOpts.enabled() || state.breaker.allows(p.breakerOpts, p.now())
+}
+
+// acquireLocked records that the upstream was handed out for a request.
+func (p *Pool) acquireLocked(upstream Proxy) {
+	if state, ok := p.states[upstream.Key()]; ok {
+		state.breaker.acquire(p.now())
+	}
+}
+
+func (p *Pool) candidatesLocked(filter Filter) []Candidate {
+	candidates := make([]Candidate, 0, len(p.proxies))
+	for _, upstream := range p.proxies {
+		if !filter.Matches(upstream) || !p.isAvailableLocked(upstream) {
+			continue
+		}
+		candidate := Candidate{Proxy: upstream}
+		if state, ok := p.states[upstream.Key()]; ok {
+			candidate.ActiveConns = state.active
+			candidate.Latency = state.latency
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+func (p *Pool) anyMatchesLocked(filter Filter) bool {
+	for _, upstream := range p.proxies {
+		if filter.Matches(upstream) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats is a point-in-time view of an upstream's runtime state.
+type Stats struct {
+	Proxy       Proxy
+	Healthy     bool
+	Disabled    bool
+	Circuit     string
+	ActiveConns int
+	Latency     time.Duration
+}
+
+// Stats returns the runtime state of every upstream in the pool.
+func (p *Pool) Stats() []Stats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stats := make([]Stats, 0, len(p.proxies))
+	for _, upstream := range p.proxies {
+		entry := Stats{Proxy: upstream, Healthy: true, Circuit: circuitClosed.String()}
+		if state, ok := p.states[upstream.Key()]; ok {
+			entry.Healthy = !state.unhealthy
+			entry.Disabled = state.disabled
+			entry.Circuit = state.breaker.state.String()
+			entry.ActiveConns = state.active
+			entry.Latency = state.latency
+		}
+		stats = append(stats, entry)
+	}
+	return stats
+}
+
+// SetDisabled takes the upstream with the given key out of selection, or puts
+// it back. Established connections are not affected. It reports whether the key exists.
+func (p *Pool) SetDisabled(key string, disabled bool) bool {
+	p.mu.Lock()
+	upstream, ok := p.findLocked(key)
+	if ok {
+		p.stateLocked(upstream).disabled = disabled
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	if disabled {
+		log.Printf("Proxy disabled: %s://%s", upstream.Protocol, upstream.Address)
+		p.evictSticky(upstream)
+	} else {
+		log.Printf("Proxy enabled: %s://%s", upstream.Protocol, upstream.Address)
+	}
+	return true
+}
+
+func (p *Pool) findLocked(key string) (Proxy, bool) {
+	for _, upstream := range p.proxies {
+		if upstream.Key() == key {
+			return upstream, true
+		}
+	}
+	return Proxy{}, false
+}
+
+// Acquire counts a connection through the upstream as active until the returned
+// release func is called. Select already does this for the upstream it returns.
+func (p *Pool) Acquire(upstream Proxy) (release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activateLocked(upstream)
+}
+
+// acquireIfAvailable hands out the upstream only if it may be selected, checking
+// and counting under one lock so concurrent callers cannot exceed max_conns or
+// the half-open trial limit, just like a fresh pick.
+func (p *Pool) acquireIfAvailable(upstream Proxy) (func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.isAvailableLocked(upstream) {
+		return nil, false
+	}
+	p.acquireLocked(upstream)
+	return p.activateLocked(upstream), true
+}
+
+// activateLocked increments the upstream's active count and returns the func undoing it once.
+func (p *Pool) activateLocked(upstream Proxy) func() {
+	state := p.stateLocked(upstream)
+	state.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			state.active--
+			p.mu.Unlock()
+		})
+	}
+}
+
+// ObserveLatency folds a successful dial latency into the upstream's EWMA.
+func (p *Pool) ObserveLatency(upstream Proxy, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.stateLocked(upstream)
+	if state.latency == 0 {
+		state.latency = latency
+		return
+	}
+	state.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(state.latency))
+}
+
+func (p *Pool) stateLocked(upstream Proxy) *proxyState {
+	key := upstream.Key()
+	state, ok := p.states[key]
+	if !ok {
+		state = &proxyState{}
+		p.states[key] = state
+	}
+	return state
+}
+
+// pruneStatesLocked drops state for upstreams no longer in the pool.
+func (p *Pool) pruneStatesLocked() {
+	present := make(map[string]struct{}, len(p.proxies))
+	for _, upstream := range p.proxies {
+		present[upstream.Key()] = struct{}{}
+	}
+	for key := range p.states {
+		if _, ok := present[key]; !ok {
+			delete(p.states, key)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultStickySweepInterval = time.Minute
+
+// StickyOptions bounds the lifetime and number of sticky sessions.
+// Zero values disable the corresponding limit.
+type StickyOptions struct {
+	// IdleTTL expires sessions that have not been used for this long.
+	IdleTTL time.Duration
+	// MaxTTL expires sessions this long after they were created, regardless of use.
+	MaxTTL time.Duration
+	// MaxSessions caps the table size; the least recently used session is evicted first.
+	MaxSessions int
+	// SweepInterval is how often RunStickySweeper purges expired sessions.
+	SweepInterval time.Duration
+}
+
+type stickyEntry struct {
+	key      string
+	upstream Proxy
+	created  time.Time
+	lastUsed time.Time
+}
+
+// stickyTable is an LRU map of session keys to upstreams with idle and absolute expiry.
+type stickyTable struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+	opts    StickyOptions
+	now     func() time.Time
+}
+
+func newStickyTable(opts StickyOptions, now func() time.Time) *stickyTable {
+	return &stickyTable{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		opts:    opts,
+		now:     now,
+	}
+}
+
+// get returns the live binding for key and marks it as recently used.
+func (t *stickyTable) get(key string) (Proxy, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	element, ok := t.entries[key]
+	if !ok {
+		return Proxy{}, false
+	}
+
+	entry := element.Value.(*stickyEntry)
+	now := t.now()
+	if t.expired(entry, now) {
+		t.removeLocked(element)
+		return Proxy{}, false
+	}
+
+	entry.lastUsed = now
+	t.order.MoveToFront(element)
+	return entry.upstream, true
+}
+
+// set binds key to upstream, evicting the least recently used session when full.
+func (t *stickyTable) set(key string, upstream Proxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if element, ok := t.entries[key]; ok {
+		entry := element.Value.(*stickyEntry)
+		entry.upstream = upstream
+		entry.lastUsed = now
+		t.order.MoveToFront(element)
+		return
+	}
+
+	entry := &stickyEntry{key: key, upstream: upstream, created: now, lastUsed: now}
+	t.entries[key] = t.order.PushFront(entry)
+
+	for t.opts.MaxSessions > 0 && t.order.Len() > t.opts.MaxSessions {
+		t.removeLocked(t.order.Back())
+	}
+}
+
+// delete removes the session and reports whether it existed.
+func (t *stickyTable) delete(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	element, ok := t.entries[key]
+	if ok {
+		t.removeLocked(element)
+	}
+	return ok
+}
+
+// list returns the live sessions, most recently used first.
+func (t *stickyTable) list() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	sessions := make([]Session, 0, t.order.Len())
+	for element := t.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*stickyEntry)
+		if t.expired(entry, now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			Key:      entry.key,
+			Proxy:    entry.upstream,
+			Created:  entry.created,
+			LastUsed: entry.lastUsed,
+		})
+	}
+	return sessions
+}
+
+// clear removes every session and returns how many there were.
+func (t *stickyTable) clear() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := t.order.Len()
+	t.entries = make(map[string]*list.Element)
+	t.order.Init()
+	return removed
+}
+
+// deleteMatching removes every session whose upstream satisfies match.
+func (t *stickyTable) deleteMatching(match func(Proxy) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for element := t.order.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*stickyEntry).upstream) {
+			t.removeLocked(element)
+		}
+		element = next
+	}
+}
+
+// sweep removes expired sessions and returns how many were dropped.
+func (t *stickyTable) sweep() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	removed := 0
+	for element := t.order.Back(); element != nil; {
+		prev := element.Prev()
+		if t.expired(element.Value.(*stickyEntry), now) {
+			t.removeLocked(element)
+			removed++
+		}
+		element = prev
+	}
+	return removed
+}
+
+func (t *stickyTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.order.Len()
+}
+
+func (t *stickyTable) expired(entry *stickyEntry, now time.Time) bool {
+	if t.opts.IdleTTL > 0 && now.Sub(entry.lastUsed) >= t.opts.IdleTTL {
+		return true
+	}
+	return t.opts.MaxTTL > 0 && now.Sub(entry.created) >= t.opts.MaxTTL
+}
+
+func (t *stickyTable) removeLocked(element *list.Element) {
+	delete(t.entries, element.Value.(*stickyEntry).key)
+	t.order.Remove(element)
+}
+
+// Session is a sticky-session binding.
+type Session struct {
+	Key      string
+	Proxy    Proxy
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Sessions returns the live sticky sessions, most recently used first.
+func (p *Pool) Sessions() []Session {
+	return p.sticky.list()
+}
+
+// DeleteSession forgets the sticky session and reports whether it existed.
+func (p *Pool) DeleteSession(key string) bool {
+	return p.sticky.delete(key)
+}
+
+// SessionCount returns the number of sticky sessions currently held.
+func (p *Pool) SessionCount() int {
+	return p.sticky.len()
+}
+
+// ClearSessions forgets every sticky session and returns how many were removed.
+func (p *Pool) ClearSessions() int {
+	return p.sticky.clear()
+}
+
+// RunStickySweeper purges expired sticky sessions until ctx is cancelled.
+func (p *Pool) RunStickySweeper(ctx context.Context) {
+	interval := p.sticky.opts.SweepInterval
+	if interval <= 0 {
+		interval = defaultStickySweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := p.sticky.sweep(); removed > 0 {
+				log.Printf("Expired %d sticky sessions", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Filter restricts selection to proxies carrying all of the given tags.
+// Keys are matched exactly after lowercasing, values case-insensitively.
+type Filter map[string]string
+
+// Matches reports whether the proxy carries every tag in the filter.
+func (f Filter) Matches(p Proxy) bool {
+	for key, want := range f {
+		got, ok := p.Tags[strings.ToLower(key)]
+		if !ok || !strings.EqualFold(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the filter as sorted key=value pairs.
+func (f Filter) String() string {
+	return formatTags(f)
+}
+
+// splitTags separates a list line from its trailing tags. Tags follow the last
+// "#", so a password may contain "#" when tags come after it; a "#" directly
+// inside the entry with no "=" after it is kept as part of the entry.
+func splitTags(line string) (entry, tags string) {
+	i := strings.LastIndex(line, "#")
+	if i < 0 {
+		return line, ""
+	}
+	if i > 0 && !unicode.IsSpace(rune(line[i-1])) && !strings.Contains(line[i+1:], "=") {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// parseTags parses a comma-separated key=value list such as "country=de,provider=x".
+func parseTags(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	tags := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid tag %q: expected key=value", strings.TrimSpace(item))
+		}
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("tag %q given more than once", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// TLSOptions configures the TLS session established with an https:// upstream proxy.
+type TLSOptions struct {
+	// ServerName overrides the SNI and verification host name.
+	ServerName string
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile provide a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables certificate verification for this upstream.
+	InsecureSkipVerify bool
+
+	once   sync.Once
+	config *tls.Config
+	err    error
+}
+
+// ClientConfig returns a TLS config for the upstream, defaulting SNI to serverName.
+func (o *TLSOptions) ClientConfig(serverName string) (*tls.Config, error) {
+	if o == nil {
+		return &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	o.once.Do(func() {
+		o.config, o.err = o.build()
+	})
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	config := o.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	return config, nil
+}
+
+func (o *TLSOptions) build() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	switch {
+	case o.CertFile != "" && o.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case o.CertFile != "" || o.KeyFile != "":
+		return nil, errors.New("client certificate requires both cert and key")
+	}
+
+	return config, nil
+}
+
+// parseTLSQuery reads TLS options from proxy URL query parameters.
+func parseTLSQuery(query url.Values) (*TLSOptions, error) {
+	if len(query) == 0 {
+		return nil, nil
+	}
+
+	opts := &TLSOptions{}
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "sni":
+			opts.ServerName = value
+		case "ca":
+			opts.CAFile = value
+		case "cert":
+			opts.CertFile = value
+		case "key":
+			opts.KeyFile = value
+		case "insecure":
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid insecure value %q", value)
+			}
+			opts.InsecureSkipVerify = insecure
+		default:
+			return nil, fmt.Errorf("unknown proxy option %q", key)
+		}
+	}
+
+	if _, err := opts.ClientConfig(""); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
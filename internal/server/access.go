@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/dialer"
+	"proxygate/internal/proxy"
+)
+
+// accessRecord collects the fields of one access-log entry while a client
+// request or tunnel is handled. It is written exactly once by finish.
+type accessRecord struct {
+	logger  *slog.Logger
+	started time.Time
+	client  string
+	user    string
+	method  string
+	target  string
+
+	mu       sync.Mutex
+	pool     string
+	upstream string
+	attempts int
+	err      error
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	once     sync.Once
+}
+
+type accessContextKey struct{}
+
+// newAccessRecord starts a record for the client request. A nil logger
+// disables access logging and makes every method a no-op.
+func newAccessRecord(logger *slog.Logger, req *http.Request) *accessRecord {
+	if logger == nil {
+		return nil
+	}
+
+	rec := &accessRecord{
+		logger:  logger,
+		started: time.Now(),
+		client:  req.RemoteAddr,
+		method:  req.Method,
+		target:  req.Host,
+	}
+	if cred, ok := auth.ProxyAuthorization(req); ok {
+		rec.user = cred.Username
+	}
+	return rec
+}
+
+func withAccess(req *http.Request, rec *accessRecord) *http.Request {
+	if rec == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), accessContextKey{}, rec))
+}
+
+// accessFrom returns the record attached by ServeHTTP, or nil when access logging is off.
+func accessFrom(req *http.Request) *accessRecord {
+	if req == nil {
+		return nil
+	}
+	rec, _ := req.Context().Value(accessContextKey{}).(*accessRecord)
+	return rec
+}
+
+func (r *accessRecord) setPool(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pool = name
+}
+
+// attempt records that the upstream is being tried for the attempt'th time.
+func (r *accessRecord) attempt(upstream proxy.Proxy, attempt int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstream = upstream.Key()
+	r.attempts = attempt
+}
+
+// fail records why the request could not be served.
+func (r *accessRecord) fail(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// received counts bytes flowing from the upstream to the client.
+func (r *accessRecord) received(n int) {
+	if r != nil {
+		r.bytesIn.Add(int64(n))
+	}
+}
+
+// sent counts bytes flowing from the client to the upstream.
+func (r *accessRecord) sent(n int) {
+	if r != nil {
+		r.bytesOut.Add(int64(n))
+	}
+}
+
+// finish writes the record with the status returned to the client. Only the first call has an effect.
+func (r *accessRecord) finish(status int) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		attrs := []slog.Attr{
+			slog.String("client", r.client),
+			slog.String("user", r.user),
+			slog.String("method", r.method),
+			slog.String("target", r.target),
+			slog.String("pool", r.pool),
+			slog.String("upstream", r.upstream),
+			slog.Int("attempts", r.attempts),
+			slog.Int("status", status),
+			slog.Int64("bytes_in", r.bytesIn.Load()),
+			slog.Int64("bytes_out", r.bytesOut.Load()),
+			slog.Float64("duration_ms", float64(time.Since(r.started).Microseconds())/1000),
+		}
+		if r.err != nil {
+			attrs = append(attrs, slog.String("error", r.err.Error()), slog.String("error_class", dialer.Class(r.err)))
+		}
+		r.logger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+	})
+}
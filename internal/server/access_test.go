@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a logger.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// records decodes every JSON line written so far.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid access log line %q: %v", line, err)
+		}
+		out = append(out, record)
+	}
+	return out
+}
+
+func deadProxy(t *testing.T) proxy.Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return proxy.Proxy{Protocol: "http", Address: addr}
+}
+
+func TestAccessLogRecordsForwardedRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	dead := deadProxy(t)
+	live := proxy.Proxy{Protocol: "http", Address: upstream.Listener.Addr().String()}
+	pool := proxy.NewPool(proxy.Options{Selector: &proxy.RoundRobinSelector{}})
+	pool.SetProxies([]proxy.Proxy{dead, live})
+
+	var logs syncBuffer
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registryOf(pool), Options{Credentials: &cred, AccessLog: slog.New(slog.NewJSONHandler(&logs, nil))})
+
+	req := httptest.NewRequest(http.MethodGet, "http://target.invalid/path", nil)
+	req.RemoteAddr = "192.0.2.10:5000"
+	req.Header.Set("Proxy-Authorization", cred.BasicHeader())
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	unauthenticated := httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+	srv.ServeHTTP(httptest.NewRecorder(), unauthenticated)
+
+	records := logs.records(t)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 access records, got %d: %v", len(records), records)
+	}
+
+	got := records[0]
+	want := map[string]any{
+		"msg":       "access",
+		"client":    "192.0.2.10:5000",
+		"user":      "alice",
+		"method":    http.MethodGet,
+		"target":    "target.invalid",
+		"pool":      "default",
+		"upstream":  live.Key(),
+		"attempts":  float64(2),
+		"status":    float64(http.StatusCreated),
+		"bytes_in":  float64(5),
+		"bytes_out": float64(0),
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("expected %s=%v, got %v in %v", key, value, got[key], got)
+		}
+	}
+	if _, ok := got["duration_ms"]; !ok {
+		t.Fatalf("expected duration_ms in %v", got)
+	}
+	if _, ok := got["error"]; ok {
+		t.Fatalf("expected no error for a served request, got %v", got)
+	}
+
+	if records[1]["status"] != float64(http.StatusProxyAuthRequired) {
+		t.Fatalf("expected 407 record for unauthenticated request, got %v", records[1])
+	}
+}
+
+func TestAccessLogRecordsFailedTunnel(t *testing.T) {
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{deadProxy(t)})
+
+	var logs syncBuffer
+	srv := httptest.NewServer(New(registryOf(pool), Options{AccessLog: slog.New(slog.NewJSONHandler(&logs, nil))}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT target.invalid:443 HTTP/1.1\r\nHost: target.invalid:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 for failed tunnel, got %d", resp.StatusCode)
+	}
+
+	records := logs.records(t)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 access record, got %v", records)
+	}
+	got := records[0]
+	if got["method"] != http.MethodConnect || got["target"] != "target.invalid:443" || got["status"] != float64(http.StatusBadGateway) {
+		t.Fatalf("unexpected tunnel record: %v", got)
+	}
+	if got["error_class"] != "network" || got["attempts"] != float64(maxRetries) {
+		t.Fatalf("expected network error after %d attempts, got %v", maxRetries, got)
+	}
+}
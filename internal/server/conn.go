@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// trackedConn runs onClose exactly once when the tunnel is closed and reports
+// the bytes read from and written to the upstream. With an idle timeout, the
+// tunnel is closed once no bytes have moved in either direction for that long.
+// Closing it also closes client, the hijacked client side of the tunnel, so a
+// tunnel torn down by the proxy never lingers half-open.
+type trackedConn struct {
+	net.Conn
+	client      net.Conn
+	once        sync.Once
+	onClose     func()
+	onRead      func(n int)
+	onWrite     func(n int)
+	idleTimeout time.Duration
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.onRead(n)
+	if n > 0 {
+		c.touch()
+	}
+	c.closeIfIdle(err)
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.onWrite(n)
+	if n > 0 {
+		c.touch()
+	}
+	c.closeIfIdle(err)
+	return n, err
+}
+
+// closeIfIdle closes the tunnel when err is the idle deadline expiring.
+func (c *trackedConn) closeIfIdle(err error) {
+	if c.idleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+		_ = c.Close()
+	}
+}
+
+// touch pushes the idle deadline back; traffic in one direction keeps a
+// blocked read or write in the other alive too.
+func (c *trackedConn) touch() {
+	if c.idleTimeout > 0 {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	if c.client != nil {
+		_ = c.client.Close()
+	}
+	c.once.Do(c.onClose)
+	return err
+}
+
+// halfCloser is implemented by connections that can shut down one direction,
+// such as *net.TCPConn.
+type halfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// halfClosingConn is a trackedConn whose upstream supports half-close. goproxy
+// only forwards a client's half-close when both ends of the tunnel expose it.
+type halfClosingConn struct {
+	*trackedConn
+}
+
+func (c halfClosingConn) CloseWrite() error {
+	return c.Conn.(halfCloser).CloseWrite()
+}
+
+func (c halfClosingConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
+
+// trackedBody runs onClose exactly once when the body is closed and reports the bytes read.
+type trackedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+	onRead  func(n int)
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.onRead(n)
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
+
+// statusWriter remembers the status code written to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets goproxy take over the connection for WebSocket upgrades.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// hijackRecorder remembers the client connection goproxy hijacks for a CONNECT
+// request, which happens before the upstream is dialed.
+type hijackRecorder struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+type clientContextKey struct{}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	w.conn = conn
+	return conn, rw, err
+}
+
+func (w *hijackRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withClient(req *http.Request, w *hijackRecorder) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientContextKey{}, w))
+}
+
+// clientFrom returns the hijacked client connection of a CONNECT request, if any.
+func clientFrom(ctx context.Context) net.Conn {
+	if w, ok := ctx.Value(clientContextKey{}).(*hijackRecorder); ok {
+		return w.conn
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"proxygate/internal/dialer"
+	"proxygate/internal/metrics"
+	"proxygate/internal/proxy"
+)
+
+const (
+	transportIdleTimeout = 90 * time.Second
+	transportMaxIdle     = 100
+)
+
+// handleRequest routes plain HTTP requests through the upstream pool.
+func (s *Server) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.RoundTripper = goproxy.RoundTripperFunc(s.roundTrip)
+	return req, nil
+}
+
+func (s *Server) roundTrip(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+	rt, err := routeFrom(req)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	resp, err := s.forward(req, rt)
+	s.metrics.ObserveRequest(metrics.KindHTTP, rt.poolName, result(err), time.Since(started))
+	if err != nil {
+		accessFrom(req).fail(err)
+	}
+	return resp, err
+}
+
+func (s *Server) forward(req *http.Request, rt route) (*http.Response, error) {
+	selected, release, err := rt.pool.Select(rt.stickyKey, rt.tags)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Routing %s via pool %s -> %s://%s", req.URL.Host, rt.poolName, selected.Protocol, selected.Address)
+	return s.forwardToProxy(req, rt, selected, release)
+}
+
+// forwardToProxy sends the request through chosen, retrying on other upstreams
+// when it can be replayed. release frees chosen and is called once the response
+// body is closed.
+func (s *Server) forwardToProxy(req *http.Request, rt route, chosen proxy.Proxy, release func()) (*http.Response, error) {
+	rec := accessFrom(req)
+	received := s.metrics.Bytes.With(metrics.KindHTTP, rt.poolName, metrics.DirectionIn)
+	replay := replayable(req)
+	if req.Body != nil && req.Body != http.NoBody {
+		sent := s.metrics.Bytes.With(metrics.KindHTTP, rt.poolName, metrics.DirectionOut)
+		req.Body = &trackedBody{
+			ReadCloser: req.Body,
+			onClose:    func() {},
+			onRead: func(n int) {
+				sent.Add(float64(n))
+				rec.sent(n)
+			},
+		}
+	}
+
+	var resp *http.Response
+	release, err := s.tryUpstreams(req.Context(), metrics.KindHTTP, rt, chosen, release, rec, replay, func(upstream proxy.Proxy) error {
+		var err error
+		resp, err = s.forwardHTTP(req, upstream)
+		if err != nil {
+			log.Printf("HTTP forward failed: %v", err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &trackedBody{
+		ReadCloser: resp.Body,
+		onClose:    release,
+		onRead: func(n int) {
+			received.Add(float64(n))
+			rec.received(n)
+		},
+	}
+	return resp, nil
+}
+
+func (s *Server) forwardHTTP(req *http.Request, upstream proxy.Proxy) (*http.Response, error) {
+	transport, err := s.transportFor(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		if s.responseTimedOut(req, err) {
+			return nil, &dialer.Error{
+				Kind:     dialer.ErrTargetTimeout,
+				Upstream: upstream.Protocol + "://" + upstream.Address,
+				Err:      fmt.Errorf("no response headers within %s: %w", s.opts.ResponseTimeout, err),
+			}
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		_ = resp.Body.Close()
+		return nil, &dialer.Error{
+			Kind:     dialer.ErrUpstreamAuth,
+			Upstream: upstream.Protocol + "://" + upstream.Address,
+			Err:      fmt.Errorf("proxy responded %s", resp.Status),
+		}
+	}
+
+	return resp, nil
+}
+
+// responseTimedOut reports whether err is the transport giving up on response
+// headers. Failures to reach the upstream arrive as *dialer.Error and expired
+// request deadlines are handled by the caller, so any other timeout is the wait
+// for the target's answer.
+func (s *Server) responseTimedOut(req *http.Request, err error) bool {
+	if s.opts.ResponseTimeout <= 0 || dialer.ContextError(req.Context(), nil) != nil {
+		return false
+	}
+	var dialErr *dialer.Error
+	if errors.As(err, &dialErr) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// transportKey identifies the settings a cached transport was built from, so an
+// upstream whose credentials or TLS options change gets a fresh transport.
+type transportKey struct {
+	url                string
+	serverName         string
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+func transportKeyFor(upstream proxy.Proxy) (transportKey, error) {
+	proxyURL, err := upstream.URL()
+	if err != nil {
+		return transportKey{}, err
+	}
+
+	key := transportKey{url: proxyURL.String()}
+	if upstream.TLS != nil {
+		key.serverName = upstream.TLS.ServerName
+		key.caFile = upstream.TLS.CAFile
+		key.certFile = upstream.TLS.CertFile
+		key.keyFile = upstream.TLS.KeyFile
+		key.insecureSkipVerify = upstream.TLS.InsecureSkipVerify
+	}
+	return key, nil
+}
+
+// transportFor returns a cached transport that sends requests via the upstream.
+func (s *Server) transportFor(upstream proxy.Proxy) (*http.Transport, error) {
+	key, err := transportKeyFor(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached, ok := s.transports.Load(key); ok {
+		return cached.(*http.Transport), nil
+	}
+
+	transport, err := dialer.NewTransport(upstream, s.DialerOptions())
+	if err != nil {
+		return nil, err
+	}
+	transport.MaxIdleConns = transportMaxIdle
+	transport.IdleConnTimeout = transportIdleTimeout
+	transport.ResponseHeaderTimeout = s.opts.ResponseTimeout
+
+	actual, _ := s.transports.LoadOrStore(key, transport)
+	return actual.(*http.Transport), nil
+}
+
+// pruneTransports closes and forgets cached transports for upstreams that are no
+// longer in any pool. It runs whenever a pool's contents change.
+func (s *Server) pruneTransports() {
+	live := make(map[transportKey]struct{})
+	for _, name := range s.pools.Names() {
+		pool, err := s.pools.Get(name)
+		if err != nil {
+			continue
+		}
+		for _, upstream := range pool.Proxies() {
+			if key, err := transportKeyFor(upstream); err == nil {
+				live[key] = struct{}{}
+			}
+		}
+	}
+
+	s.transports.Range(func(key, value any) bool {
+		if _, ok := live[key.(transportKey)]; !ok {
+			s.transports.Delete(key)
+			value.(*http.Transport).CloseIdleConnections()
+		}
+		return true
+	})
+}
+
+// replayable reports whether the request can be retried against another
+// upstream: it must be idempotent, and have no body that the failed attempt
+// may already have consumed.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
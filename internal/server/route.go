@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+)
+
+// poolHeader lets clients pick a named pool per request.
+const poolHeader = "X-Proxy-Pool"
+
+// Username options with a fixed meaning; any other option is a proxy tag.
+const (
+	optionPool    = "pool"
+	optionSession = auth.SessionOption
+)
+
+// route is the upstream routing decided for a client request.
+type route struct {
+	poolName  string
+	pool      *proxy.Pool
+	stickyKey string
+	// tags are the remaining username options, e.g. country=de.
+	tags proxy.Filter
+}
+
+type routeContextKey struct{}
+
+// resolveRoute picks the pool, sticky key and tags for the request from its
+// headers and username options. Headers win over the username: the pool comes
+// from X-Proxy-Pool, then the "pool" option, then the registry default, and the
+// sticky key from the pool's sticky header, then the "session" option.
+func (s *Server) resolveRoute(req *http.Request, options map[string]string) (route, error) {
+	name := req.Header.Get(poolHeader)
+	if name == "" {
+		name = options[optionPool]
+	}
+
+	pool, err := s.pools.Get(name)
+	if err != nil {
+		return route{}, err
+	}
+	if name == "" {
+		name = s.pools.DefaultName()
+	}
+
+	stickyKey := req.Header.Get(pool.StickyHeader())
+	if stickyKey == "" {
+		stickyKey = options[optionSession]
+	}
+
+	var tags proxy.Filter
+	for key, value := range options {
+		if key == optionPool || key == optionSession {
+			continue
+		}
+		if tags == nil {
+			tags = make(proxy.Filter, len(options))
+		}
+		tags[key] = value
+	}
+
+	return route{
+		poolName:  name,
+		pool:      pool,
+		stickyKey: stickyKey,
+		tags:      tags,
+	}, nil
+}
+
+// stripRouting removes headers that only steer the gateway and must not reach upstreams.
+func stripRouting(req *http.Request, rt route) {
+	auth.RemoveProxyAuthorization(req)
+	req.Header.Del(poolHeader)
+	req.Header.Del(rt.pool.StickyHeader())
+}
+
+func withRoute(req *http.Request, rt route) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeContextKey{}, rt))
+}
+
+// routeFrom returns the route attached by ServeHTTP.
+func routeFrom(req *http.Request) (route, error) {
+	if req == nil {
+		return route{}, fmt.Errorf("missing client request")
+	}
+	rt, ok := req.Context().Value(routeContextKey{}).(route)
+	if !ok {
+		return route{}, fmt.Errorf("request was not routed")
+	}
+	return rt, nil
+}
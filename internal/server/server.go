@@ -1,214 +1,527 @@
 package server
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elazarl/goproxy"
-	socks "golang.org/x/net/proxy"
 
 	"proxygate/internal/auth"
+	"proxygate/internal/dialer"
+	"proxygate/internal/metrics"
 	"proxygate/internal/proxy"
+	"proxygate/internal/redact"
 )
 
 const (
 	maxRetries           = 3
-	errorRespMaxLength   = 500
 	defaultListenAddress = ":8080"
+	authRealm            = "proxygate"
+	// shutdownPollInterval is how often Shutdown checks whether the last tunnel has closed.
+	shutdownPollInterval = 100 * time.Millisecond
 )
 
 // Options configures the server runtime.
 type Options struct {
 	ListenAddr string
 	Verbose    bool
+	// Credentials, when set, are required from every client via Proxy-Authorization.
+	Credentials *auth.Credentials
+	// Metrics records traffic; a private set is used when nil.
+	Metrics *metrics.Metrics
+	// AccessLog receives one record per client request or tunnel; nil disables it.
+	AccessLog *slog.Logger
+	// DialTimeout bounds connecting to an upstream proxy.
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds opening a tunnel through an upstream once dialing starts.
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes CONNECT tunnels without traffic in either direction for this long.
+	IdleTimeout time.Duration
+	// RequestTimeout bounds a plain HTTP request, or opening a tunnel, retries included.
+	RequestTimeout time.Duration
+	// ResponseTimeout bounds the wait for response headers to a plain HTTP request.
+	// Expiry is blamed on the target, so the request is neither retried nor counted
+	// against the upstream. Each timeout is disabled when zero.
+	ResponseTimeout time.Duration
+	// ShutdownDelay keeps serving after Shutdown starts, with /readyz answering
+	// 503, so load balancers stop routing new clients before draining begins.
+	ShutdownDelay time.Duration
 }
 
-// Server wraps the goproxy server and upstream proxy pool.
+// Server wraps the goproxy server and the registry of upstream proxy pools.
 type Server struct {
-	httpProxy *goproxy.ProxyHttpServer
-	pool      *proxy.Pool
-	opts      Options
+	httpProxy  *goproxy.ProxyHttpServer
+	httpServer *http.Server
+	pools      *proxy.Registry
+	opts       Options
+	metrics    *metrics.Metrics
+	// transports caches one http.Transport per upstream for plain HTTP forwarding,
+	// keyed by transportKey and pruned when pools change.
+	transports sync.Map
+	// draining rejects new client requests while established tunnels finish.
+	draining atomic.Bool
+	// stopping fails readiness as soon as Shutdown starts, before draining.
+	stopping atomic.Bool
+
+	// tunnels holds the open CONNECT tunnels so Shutdown can close them, and
+	// connecting counts CONNECTs that have not opened their tunnel yet: goproxy
+	// hijacks them before dialing, so http.Server no longer waits for them.
+	tunnelsMu  sync.Mutex
+	tunnels    map[*trackedConn]struct{}
+	connecting int
 }
 
 // New creates a new Server.
-func New(pool *proxy.Pool, opts Options) *Server {
+func New(pools *proxy.Registry, opts Options) *Server {
 	if opts.ListenAddr == "" {
 		opts.ListenAddr = defaultListenAddress
 	}
 
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.New()
+	}
+
 	p := goproxy.NewProxyHttpServer()
 	p.Verbose = opts.Verbose
+	// Share the standard logger so goproxy output passes through the same redaction.
+	p.Logger = log.Default()
 
 	s := &Server{
 		httpProxy: p,
-		pool:      pool,
+		pools:     pools,
 		opts:      opts,
+		metrics:   opts.Metrics,
+		tunnels:   make(map[*trackedConn]struct{}),
 	}
+	s.httpServer = &http.Server{Addr: opts.ListenAddr, Handler: s}
 
 	p.ConnectDialWithReq = s.connectDialHandler
+	p.OnRequest().DoFunc(s.handleRequest)
+	p.NonproxyHandler = s.probeHandler(p.NonproxyHandler)
+
+	for _, name := range pools.Names() {
+		if pool, err := pools.Get(name); err == nil {
+			pool.OnChange(s.pruneTransports)
+		}
+	}
 	return s
 }
 
-// ListenAndServe starts the HTTP proxy server.
+// ListenAndServe starts the HTTP proxy server. It returns nil once Shutdown has been called.
 func (s *Server) ListenAndServe() error {
-	log.Printf("Starting HTTP proxy server on %s", s.opts.ListenAddr)
-	return http.ListenAndServe(s.opts.ListenAddr, s.httpProxy)
+	listener, err := net.Listen("tcp", s.opts.ListenAddr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
 }
 
-func (s *Server) connectDialHandler(req *http.Request, network, addr string) (net.Conn, error) {
-	stickyHeader := s.pool.StickyHeader()
-	stickyKey := ""
-	requestURI := ""
-	if req != nil {
-		stickyKey = req.Header.Get(stickyHeader)
-		requestURI = req.RequestURI
-		log.Printf("Headers: \n%s", req.Header)
+// Serve accepts proxy clients on listener until Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	log.Printf("Starting HTTP proxy server on %s", listener.Addr())
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
+}
 
-	selected, err := s.pool.Select(stickyKey)
-	if err != nil {
-		return nil, err
+// Shutdown drains the server: it fails readiness, keeps serving for
+// ShutdownDelay so probes can observe that, stops accepting connections, waits
+// for in-flight requests, CONNECTs and open tunnels to finish, and force-closes
+// the tunnels still open when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopping.Store(true)
+	if s.opts.ShutdownDelay > 0 && !s.Draining() {
+		// Requests are still served normally while load balancers notice.
+		log.Printf("Shutting down: failing readiness for %s before draining", s.opts.ShutdownDelay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.opts.ShutdownDelay):
+		}
 	}
+	s.Drain()
+	log.Printf("Shutting down: waiting for %d open tunnels", s.TunnelCount())
+
+	// http.Server does not track hijacked connections, so CONNECTs and their
+	// tunnels are waited for separately.
+	err := s.httpServer.Shutdown(ctx)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.pending() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain timeout: closing %d open tunnels", s.closeTunnels())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
 
-	log.Printf("Sticky selection for %s -> %s://%s", requestURI, selected.Protocol, selected.Address)
-	return s.newConnectDialToProxy(network, addr, stickyKey, selected)
+// TunnelCount returns the number of open CONNECT tunnels.
+func (s *Server) TunnelCount() int {
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+	return len(s.tunnels)
 }
 
-func (s *Server) newConnectDialToProxy(network, addr, stickyKey string, chosen proxy.Proxy) (net.Conn, error) {
-	current := chosen
+// pending returns the number of open tunnels plus the CONNECTs still opening one.
+func (s *Server) pending() int {
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+	return len(s.tunnels) + s.connecting
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Selected proxy: %s://%s (attempt %d/%d)", current.Protocol, current.Address, attempt, maxRetries)
+// closeTunnels closes every open tunnel and returns how many there were.
+func (s *Server) closeTunnels() int {
+	s.tunnelsMu.Lock()
+	open := make([]*trackedConn, 0, len(s.tunnels))
+	for conn := range s.tunnels {
+		open = append(open, conn)
+	}
+	s.tunnelsMu.Unlock()
 
-		if current.Protocol == "socks5" {
-			conn, err := tryConnectSocks5Proxy(network, addr, current)
-			if err == nil {
-				return conn, nil
-			}
-			log.Printf("SOCKS5 connect failed: %v", err)
-		}
+	// Closing a tunnel closes its client side too.
+	for _, conn := range open {
+		_ = conn.Close()
+	}
+	return len(open)
+}
 
-		conn, err := s.connectHTTPProxy(network, addr, current)
-		if err == nil {
-			return conn, nil
+// probeHandler answers the /healthz and /readyz probes and passes every other
+// non-proxy request to next. /readyz fails once Shutdown starts or the server
+// drains, so load balancers stop sending new clients.
+func (s *Server) probeHandler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if s.Draining() || s.stopping.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
 		}
+		_, _ = w.Write([]byte("ready\n"))
+	})
+	mux.Handle("/", next)
+	return mux
+}
 
-		log.Printf("HTTP connect failed: %v", err)
-		s.pool.MarkFailed(current)
-
-		next, nextErr := s.pool.Select("")
-		if nextErr != nil {
-			return nil, fmt.Errorf("failed to acquire replacement proxy: %w", nextErr)
-		}
-		s.pool.BindSticky(stickyKey, next)
-		current = next
+// Drain makes the server refuse new client requests with 503 while
+// established tunnels and in-flight requests run to completion.
+func (s *Server) Drain() {
+	if s.draining.CompareAndSwap(false, true) {
+		log.Printf("Draining: refusing new proxy requests")
 	}
+}
 
-	return nil, fmt.Errorf("failed to connect after %d attempts", maxRetries)
+// Draining reports whether Drain has been called.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
 }
 
-func (s *Server) connectHTTPProxy(network, addr string, upstream proxy.Proxy) (net.Conn, error) {
-	proxyURL, err := upstream.URL()
+// ServeHTTP authenticates and routes the client request before handing it to goproxy.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		// Requests addressed to the proxy itself, such as health probes, are
+		// not proxied and need no credentials.
+		req.Header.Del("Proxy-Authorization")
+		s.httpProxy.ServeHTTP(w, req)
+		return
+	}
+
+	rec := newAccessRecord(s.opts.AccessLog, req)
+
+	if s.Draining() {
+		s.metrics.Requests.With(requestKind(req), "", "draining").Inc()
+		w.Header().Set("Connection", "close")
+		http.Error(w, "proxy is draining", http.StatusServiceUnavailable)
+		rec.finish(http.StatusServiceUnavailable)
+		return
+	}
+
+	options, err := s.authenticate(req)
+	if errors.Is(err, errUnauthenticated) {
+		log.Printf("Rejecting unauthenticated %s request from %s", req.Method, req.RemoteAddr)
+		s.metrics.Requests.With(requestKind(req), "", "unauthorized").Inc()
+		auth.SetProxyAuthenticate(w.Header(), authRealm)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		rec.finish(http.StatusProxyAuthRequired)
+		return
+	}
+
+	// A remaining error means malformed username options, which are a bad request.
+	var rt route
+	if err == nil {
+		rt, err = s.resolveRoute(req, options)
+	}
 	if err != nil {
-		return nil, err
+		log.Printf("Rejecting %s request from %s: %v", req.Method, req.RemoteAddr, err)
+		s.metrics.Requests.With(requestKind(req), "", "bad_request").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		rec.fail(err)
+		rec.finish(http.StatusBadRequest)
+		return
 	}
+	rec.setPool(rt.poolName)
+
+	stripRouting(req, rt)
+	req = withAccess(withRoute(req, rt), rec)
+	if s.opts.RequestTimeout > 0 {
+		// goproxy returns once a tunnel is established, so this never limits a tunnel's lifetime.
+		ctx, cancel := context.WithTimeout(req.Context(), s.opts.RequestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if req.Method == http.MethodConnect {
+		// goproxy returns once the tunnel is registered or has failed; until
+		// then Shutdown waits for the CONNECT. The connection is still tracked
+		// by http.Server here, so Shutdown cannot miss it.
+		s.tunnelsMu.Lock()
+		s.connecting++
+		s.tunnelsMu.Unlock()
+		defer func() {
+			s.tunnelsMu.Lock()
+			s.connecting--
+			s.tunnelsMu.Unlock()
+		}()
+
+		// The record is finished when the tunnel closes or fails to open.
+		hw := &hijackRecorder{ResponseWriter: w}
+		s.httpProxy.ServeHTTP(hw, withClient(req, hw))
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	s.httpProxy.ServeHTTP(sw, req)
+	rec.finish(sw.status)
+}
+
+// errUnauthenticated rejects a client without valid credentials.
+var errUnauthenticated = errors.New("proxy authentication required")
+
+// authenticate validates Proxy-Authorization and returns the routing options
+// encoded in the username. Without configured credentials every client is
+// accepted. A client with valid credentials but malformed options gets an
+// error wrapping auth.ErrInvalidOptions rather than errUnauthenticated.
+func (s *Server) authenticate(req *http.Request) (map[string]string, error) {
+	cred, present := auth.ProxyAuthorization(req)
 
-	host := proxyURL.Host
-	if !containsPort(host) {
-		switch upstream.Protocol {
-		case "https":
-			host += ":443"
-		default:
-			host += ":80"
+	if s.opts.Credentials == nil {
+		if !present {
+			return nil, nil
 		}
+		// Without an account to check, malformed options are still a bad request.
+		_, options, err := auth.ParseUsername(cred.Username, "")
+		return options, err
 	}
 
-	connectReq := &http.Request{
-		Method: http.MethodConnect,
-		URL:    &url.URL{Opaque: addr},
-		Host:   addr,
-		Header: make(http.Header),
+	if !present {
+		return nil, errUnauthenticated
 	}
-
-	if upstream.Credentials != nil {
-		auth.SetProxyAuthorization(connectReq, *upstream.Credentials)
+	base, options, err := auth.ParseUsername(cred.Username, s.opts.Credentials.Username)
+	if err != nil && !errors.Is(err, auth.ErrInvalidOptions) {
+		return nil, errUnauthenticated
+	}
+	if !(auth.Credentials{Username: base, Password: cred.Password}).Equal(*s.opts.Credentials) {
+		return nil, errUnauthenticated
 	}
+	return options, err
+}
 
-	conn, err := s.dial(network, host, connectReq)
+func (s *Server) connectDialHandler(req *http.Request, network, addr string) (net.Conn, error) {
+	rt, err := routeFrom(req)
 	if err != nil {
 		return nil, err
 	}
+	log.Printf("Headers: %s", strings.Join(redact.HeaderNames(req.Header), ", "))
 
-	if err := connectReq.Write(conn); err != nil {
-		_ = conn.Close()
-		return nil, err
+	started := time.Now()
+	conn, err := s.connectDial(req, network, addr, rt)
+	s.metrics.ObserveRequest(metrics.KindConnect, rt.poolName, result(err), time.Since(started))
+	if err != nil {
+		rec := accessFrom(req)
+		rec.fail(err)
+		// goproxy answers a failed dial with 502 Bad Gateway.
+		rec.finish(http.StatusBadGateway)
 	}
+	return conn, err
+}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+func (s *Server) connectDial(req *http.Request, network, addr string, rt route) (net.Conn, error) {
+	selected, release, err := rt.pool.Select(rt.stickyKey, rt.tags)
 	if err != nil {
-		_ = conn.Close()
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, readErr := io.ReadAll(io.LimitReader(resp.Body, errorRespMaxLength))
-		if readErr != nil {
-			_ = conn.Close()
-			return nil, readErr
+	log.Printf("Routing %s via pool %s -> %s://%s", req.RequestURI, rt.poolName, selected.Protocol, selected.Address)
+	return s.newConnectDialToProxy(req.Context(), network, addr, rt, selected, release, accessFrom(req))
+}
+
+// newConnectDialToProxy opens a tunnel through chosen, retrying on other
+// upstreams. release frees chosen and passes to the tunnel on success.
+func (s *Server) newConnectDialToProxy(ctx context.Context, network, addr string, rt route, chosen proxy.Proxy, release func(), rec *accessRecord) (net.Conn, error) {
+	var conn net.Conn
+	release, err := s.tryUpstreams(ctx, metrics.KindConnect, rt, chosen, release, rec, true, func(upstream proxy.Proxy) error {
+		var err error
+		conn, err = s.dialThrough(ctx, network, addr, upstream)
+		if err != nil {
+			log.Printf("Upstream connect failed: %v", err)
 		}
-		_ = conn.Close()
-		return nil, errors.New("proxy refused connection: " + string(body))
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return conn, nil
+	return s.newTunnel(conn, clientFrom(ctx), rt, release, rec), nil
 }
 
-func (s *Server) dial(network, addr string, ctxReq *http.Request) (net.Conn, error) {
-	ctx := &goproxy.ProxyCtx{Req: ctxReq}
+// tryUpstreams runs try against chosen and, while failures are the upstream's
+// fault and replay is set, against replacements from the pool, for up to
+// maxRetries attempts. Each upstream is acquired as soon as it is selected so
+// concurrent selections see it as busy. On success the caller owns the returned
+// release; on failure every upstream has already been released.
+func (s *Server) tryUpstreams(ctx context.Context, kind string, rt route, chosen proxy.Proxy, release func(), rec *accessRecord, replay bool, try func(proxy.Proxy) error) (func(), error) {
+	current := chosen
+	for attempt := 1; ; attempt++ {
+		log.Printf("Selected proxy: %s://%s (attempt %d/%d)", current.Protocol, current.Address, attempt, maxRetries)
+		rec.attempt(current, attempt)
+
+		started := time.Now()
+		err := try(current)
+		if err == nil {
+			rt.pool.ObserveLatency(current, time.Since(started))
+			s.metrics.ObserveDial(rt.poolName, current, time.Since(started))
+			rt.pool.MarkSucceeded(current)
+			return release, nil
+		}
+		release()
+
+		if !dialer.IsUpstreamFault(err) {
+			// The upstream answered; only the target was unreachable.
+			rt.pool.MarkSucceeded(current)
+			return nil, err
+		}
+		if ctxErr := dialer.ContextError(ctx, nil); ctxErr != nil {
+			// The request timed out or the client left; the upstream is not to blame.
+			return nil, fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		s.markFailed(rt, current)
+		if !replay {
+			return nil, err
+		}
+		if attempt == maxRetries {
+			return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, err)
+		}
+
+		next, nextRelease, nextErr := rt.pool.Select("", rt.tags)
+		if nextErr != nil {
+			return nil, fmt.Errorf("failed to acquire replacement proxy: %w", nextErr)
+		}
+		rt.pool.BindSticky(rt.stickyKey, next)
+		current = next
+		release = nextRelease
+		s.metrics.Retries.With(kind, rt.poolName).Inc()
+	}
+}
 
-	if ctx.Dialer != nil {
-		return ctx.Dialer(ctxReq.Context(), network, addr)
+// newTunnel wraps an established upstream connection so that closing it
+// releases the upstream and writes the access record, and its traffic is counted.
+func (s *Server) newTunnel(conn, client net.Conn, rt route, release func(), rec *accessRecord) net.Conn {
+	active := s.metrics.ActiveTunnels.With(rt.poolName)
+	active.Inc()
+	received := s.metrics.Bytes.With(metrics.KindConnect, rt.poolName, metrics.DirectionIn)
+	sent := s.metrics.Bytes.With(metrics.KindConnect, rt.poolName, metrics.DirectionOut)
+
+	tunnel := &trackedConn{Conn: conn, client: client, idleTimeout: s.opts.IdleTimeout}
+	tunnel.touch()
+	tunnel.onClose = func() {
+		s.tunnelsMu.Lock()
+		delete(s.tunnels, tunnel)
+		s.tunnelsMu.Unlock()
+		active.Dec()
+		release()
+		rec.finish(http.StatusOK)
+	}
+	tunnel.onRead = func(n int) {
+		received.Add(float64(n))
+		rec.received(n)
+	}
+	tunnel.onWrite = func(n int) {
+		sent.Add(float64(n))
+		rec.sent(n)
 	}
 
-	if s.httpProxy.Tr != nil && s.httpProxy.Tr.DialContext != nil {
-		return s.httpProxy.Tr.DialContext(ctxReq.Context(), network, addr)
+	s.tunnelsMu.Lock()
+	s.tunnels[tunnel] = struct{}{}
+	s.tunnelsMu.Unlock()
+
+	if _, ok := conn.(halfCloser); ok {
+		return halfClosingConn{tunnel}
 	}
+	return tunnel
+}
 
-	return net.Dial(network, addr)
+// markFailed reports an upstream fault to the pool and counts it.
+func (s *Server) markFailed(rt route, upstream proxy.Proxy) {
+	rt.pool.MarkFailed(upstream)
+	s.metrics.Failures.With(rt.poolName, upstream.Key()).Inc()
 }
 
-func containsPort(host string) bool {
-	for i := len(host) - 1; i >= 0; i-- {
-		if host[i] == ':' {
-			return true
-		}
-		if host[i] == ']' {
-			break
-		}
+// requestKind returns the "kind" metrics label for a client request.
+func requestKind(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return metrics.KindConnect
 	}
-	return false
+	return metrics.KindHTTP
 }
 
-func tryConnectSocks5Proxy(network, addr string, upstream proxy.Proxy) (net.Conn, error) {
-	var credentials *socks.Auth
-	if upstream.Credentials != nil && upstream.Credentials.IsValid() {
-		credentials = &socks.Auth{
-			User:     upstream.Credentials.Username,
-			Password: upstream.Credentials.Password,
-		}
+// result returns the "result" metrics label for a request outcome.
+func result(err error) string {
+	if err == nil {
+		return metrics.ResultOK
 	}
+	return dialer.Class(err)
+}
 
-	dialer, err := socks.SOCKS5("tcp", upstream.Address, credentials, socks.Direct)
+// dialThrough opens a tunnel to addr using the upstream's protocol-specific dialer.
+func (s *Server) dialThrough(ctx context.Context, network, addr string, upstream proxy.Proxy) (net.Conn, error) {
+	d, err := s.dialerFor(upstream)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (s *Server) dialerFor(upstream proxy.Proxy) (dialer.Dialer, error) {
+	return dialer.For(upstream, s.DialerOptions())
+}
+
+// DialerOptions returns the options upstreams are dialed with, so that health
+// probes connect the same way as proxied traffic.
+func (s *Server) DialerOptions() dialer.Options {
+	return dialer.Options{
+		Forward:          s.dial,
+		DialTimeout:      s.opts.DialTimeout,
+		HandshakeTimeout: s.opts.HandshakeTimeout,
+	}
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.httpProxy.Tr != nil && s.httpProxy.Tr.DialContext != nil {
+		return s.httpProxy.Tr.DialContext(ctx, network, addr)
 	}
 
-	return dialer.Dial(network, addr)
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
 }
@@ -0,0 +1,1152 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/metrics"
+	"proxygate/internal/proxy"
+	"proxygate/internal/redact"
+)
+
+func TestServeHTTPRequiresProxyAuthorization(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registryOf(proxy.NewPool(proxy.Options{})), Options{Credentials: &cred})
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     string
+		wantStatus int
+	}{
+		{"connect without header", http.MethodConnect, "example.com:443", "", http.StatusProxyAuthRequired},
+		{"get without header", http.MethodGet, backend.URL, "", http.StatusProxyAuthRequired},
+		{"get with wrong password", http.MethodGet, backend.URL, auth.Credentials{Username: "alice", Password: "nope"}.BasicHeader(), http.StatusProxyAuthRequired},
+		{"get with malformed header", http.MethodGet, backend.URL, "Basic !!!", http.StatusProxyAuthRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Proxy-Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			srv.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired && rec.Header().Get("Proxy-Authenticate") == "" {
+				t.Fatalf("expected Proxy-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestServeHTTPStripsProxyAuthorization(t *testing.T) {
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registryOf(proxy.NewPool(proxy.Options{})), Options{Credentials: &cred})
+
+	var forwarded http.Header
+	srv.httpProxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Proxy-Authorization", cred.BasicHeader())
+	rec := httptest.NewRecorder()
+
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected request to be accepted, got %d", rec.Code)
+	}
+	if forwarded.Get("Proxy-Authorization") != "" {
+		t.Fatalf("expected Proxy-Authorization to be stripped before forwarding")
+	}
+}
+
+func TestServeHTTPForwardsPlainRequestsThroughUpstream(t *testing.T) {
+	var gotURI, gotSession, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		gotSession = r.Header.Get("X-Proxy-Session")
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	upstreamCred := &auth.Credentials{Username: "up", Password: "stream"}
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{{Protocol: "http", Address: upstream.Listener.Addr().String(), Credentials: upstreamCred}})
+	srv := New(registryOf(pool), Options{})
+
+	req := httptest.NewRequest(http.MethodGet, "http://target.invalid/path?q=1", nil)
+	req.Header.Set("X-Proxy-Session", "session-1")
+	rec := httptest.NewRecorder()
+
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("expected upstream response to be relayed, got %d", rec.Code)
+	}
+	if gotURI != "http://target.invalid/path?q=1" {
+		t.Fatalf("expected absolute-URI request at upstream, got %q", gotURI)
+	}
+	if gotSession != "" {
+		t.Fatalf("expected sticky header to be stripped, got %q", gotSession)
+	}
+	if gotAuth != upstreamCred.BasicHeader() {
+		t.Fatalf("expected upstream credentials, got %q", gotAuth)
+	}
+}
+
+func TestPlainRequestsRetryOnlyWhenReplayable(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer upstream.Close()
+
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{{Protocol: "http", Address: upstream.Listener.Addr().String()}})
+	recorder := metrics.New()
+	srv := New(registryOf(pool), Options{Metrics: recorder})
+
+	req := httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+	req.Header.Set("X-Proxy-Session", "session-1")
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+	if got := hits.Load(); got != maxRetries {
+		t.Fatalf("expected a GET to be tried %d times, got %d", maxRetries, got)
+	}
+	if got := recorder.Retries.With(metrics.KindHTTP, "default").Value(); got != maxRetries-1 {
+		t.Fatalf("expected %d retries, got %v", maxRetries-1, got)
+	}
+	if got := pool.SessionCount(); got != 0 {
+		t.Fatalf("expected no replacement to be bound after the last attempt, got %d sessions", got)
+	}
+
+	hits.Store(0)
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://target.invalid/", nil))
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("expected a bodyless POST to be tried once, got %d", got)
+	}
+}
+
+func TestServeHTTPForwardsThroughTLSUpstream(t *testing.T) {
+	var gotURI string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{{
+		Protocol: "https",
+		Address:  upstream.Listener.Addr().String(),
+		TLS:      &proxy.TLSOptions{CAFile: caPath},
+	}})
+	srv := New(registryOf(pool), Options{})
+
+	req := httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+	rec := httptest.NewRecorder()
+
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("expected upstream response over TLS, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if gotURI != "http://target.invalid/" {
+		t.Fatalf("expected absolute-URI request at upstream, got %q", gotURI)
+	}
+}
+
+func registryOf(pool *proxy.Pool) *proxy.Registry {
+	registry := proxy.NewRegistry()
+	_ = registry.Add("default", pool)
+	return registry
+}
+
+func TestServeHTTPSelectsNamedPool(t *testing.T) {
+	newUpstream := func(status int) (*httptest.Server, *proxy.Pool) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Proxy-Pool") != "" {
+				t.Errorf("expected pool header to be stripped")
+			}
+			w.WriteHeader(status)
+		}))
+		pool := proxy.NewPool(proxy.Options{})
+		pool.SetProxies([]proxy.Proxy{{Protocol: "http", Address: upstream.Listener.Addr().String()}})
+		return upstream, pool
+	}
+
+	datacenter, datacenterPool := newUpstream(http.StatusOK)
+	defer datacenter.Close()
+	mobile, mobilePool := newUpstream(http.StatusAccepted)
+	defer mobile.Close()
+
+	registry := proxy.NewRegistry()
+	_ = registry.Add("datacenter", datacenterPool)
+	_ = registry.Add("mobile", mobilePool)
+
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registry, Options{Credentials: &cred})
+
+	tests := []struct {
+		name       string
+		username   string
+		header     string
+		wantStatus int
+	}{
+		{"default pool", "alice", "", http.StatusOK},
+		{"pool header", "alice", "mobile", http.StatusAccepted},
+		{"pool in username", "alice-pool-mobile", "", http.StatusAccepted},
+		{"header wins over username", "alice-pool-mobile", "datacenter", http.StatusOK},
+		{"unknown pool", "alice", "residential", http.StatusBadRequest},
+		{"foreign account prefix", "bob-pool-mobile", "", http.StatusProxyAuthRequired},
+		{"unmatched tags", "alice-country-de", "", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+			req.Header.Set("Proxy-Authorization", auth.Credentials{Username: tt.username, Password: "secret"}.BasicHeader())
+			if tt.header != "" {
+				req.Header.Set("X-Proxy-Pool", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			srv.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRejectsMalformedOptionsAsBadRequest(t *testing.T) {
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registryOf(proxy.NewPool(proxy.Options{})), Options{Credentials: &cred})
+	anonymous := New(registryOf(proxy.NewPool(proxy.Options{})), Options{})
+
+	tests := []struct {
+		name       string
+		srv        *Server
+		cred       auth.Credentials
+		wantStatus int
+	}{
+		{"valid password", srv, auth.Credentials{Username: "alice-pool", Password: "secret"}, http.StatusBadRequest},
+		{"wrong password", srv, auth.Credentials{Username: "alice-pool", Password: "nope"}, http.StatusProxyAuthRequired},
+		{"no authentication", anonymous, auth.Credentials{Username: "alice-pool", Password: "any"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			req.Header.Set("Proxy-Authorization", tt.cred.BasicHeader())
+			rec := httptest.NewRecorder()
+			tt.srv.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestResolveRouteFromUsernameOptions(t *testing.T) {
+	registry := proxy.NewRegistry()
+	_ = registry.Add("datacenter", proxy.NewPool(proxy.Options{}))
+	_ = registry.Add("mobile", proxy.NewPool(proxy.Options{}))
+
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registry, Options{Credentials: &cred})
+
+	tests := []struct {
+		name     string
+		username string
+		session  string
+		wantPool string
+		wantKey  string
+		wantTags map[string]string
+	}{
+		{name: "defaults", username: "alice", wantPool: "datacenter"},
+		{
+			name:     "all options",
+			username: "alice-pool-mobile-country-de-session-abc123",
+			wantPool: "mobile",
+			wantKey:  "abc123",
+			wantTags: map[string]string{"country": "de"},
+		},
+		{
+			name:     "dashed session",
+			username: "alice-pool-mobile-session-550e8400-e29b",
+			wantPool: "mobile",
+			wantKey:  "550e8400-e29b",
+		},
+		{
+			name:     "session header wins",
+			username: "alice-city-berlin-session-abc123",
+			session:  "from-header",
+			wantPool: "datacenter",
+			wantKey:  "from-header",
+			wantTags: map[string]string{"city": "berlin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			req.Header.Set("Proxy-Authorization", auth.Credentials{Username: tt.username, Password: "secret"}.BasicHeader())
+			if tt.session != "" {
+				req.Header.Set("X-Proxy-Session", tt.session)
+			}
+
+			options, err := srv.authenticate(req)
+			if err != nil {
+				t.Fatalf("expected %q to authenticate, got %v", tt.username, err)
+			}
+			rt, err := srv.resolveRoute(req, options)
+			if err != nil {
+				t.Fatalf("resolveRoute returned error: %v", err)
+			}
+
+			if rt.poolName != tt.wantPool || rt.stickyKey != tt.wantKey {
+				t.Fatalf("expected pool %q key %q, got pool %q key %q", tt.wantPool, tt.wantKey, rt.poolName, rt.stickyKey)
+			}
+			if len(rt.tags) != len(tt.wantTags) {
+				t.Fatalf("expected tags %v, got %v", tt.wantTags, rt.tags)
+			}
+			for key, value := range tt.wantTags {
+				if rt.tags[key] != value {
+					t.Fatalf("expected tags %v, got %v", tt.wantTags, rt.tags)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPRecordsMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := proxy.Proxy{Protocol: "http", Address: listener.Addr().String()}
+	_ = listener.Close()
+	live := proxy.Proxy{Protocol: "http", Address: upstream.Listener.Addr().String()}
+
+	pool := proxy.NewPool(proxy.Options{Selector: &proxy.RoundRobinSelector{}})
+	pool.SetProxies([]proxy.Proxy{dead, live})
+	recorder := metrics.New()
+	srv := New(registryOf(pool), Options{Metrics: recorder})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("expected relayed response, got %d: %q", rec.Code, rec.Body.String())
+	}
+
+	if got := recorder.Requests.With(metrics.KindHTTP, "default", metrics.ResultOK).Value(); got != 1 {
+		t.Fatalf("expected 1 successful request, got %v", got)
+	}
+	if got := recorder.Failures.With("default", dead.Key()).Value(); got != 1 {
+		t.Fatalf("expected 1 failure for dead upstream, got %v", got)
+	}
+	if got := recorder.Retries.With(metrics.KindHTTP, "default").Value(); got != 1 {
+		t.Fatalf("expected 1 retry, got %v", got)
+	}
+	if got := recorder.DialDuration.With("default", live.Key()).Count(); got != 1 {
+		t.Fatalf("expected 1 dial observation for live upstream, got %d", got)
+	}
+	if got := recorder.Bytes.With(metrics.KindHTTP, "default", metrics.DirectionIn).Value(); got != 5 {
+		t.Fatalf("expected 5 bytes in, got %v", got)
+	}
+}
+
+// newAuthConnectProxy starts an upstream HTTP proxy that requires the expected
+// credentials. It tunnels CONNECT requests and answers plain requests itself.
+func newAuthConnectProxy(t *testing.T, want auth.Credentials) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cred, ok := auth.ProxyAuthorization(r); !ok || !cred.Equal(want) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(target, conn)
+			_ = target.(*net.TCPConn).CloseWrite()
+		}()
+		_, _ = io.Copy(conn, target)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLogsNeverContainCredentials(t *testing.T) {
+	var logs syncBuffer
+	previous := log.Writer()
+	log.SetOutput(redact.NewWriter(&logs))
+	t.Cleanup(func() { log.SetOutput(previous) })
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	clientCred := auth.Credentials{Username: "client", Password: "client-s3cret"}
+	upstreamCred := auth.Credentials{Username: "upstream", Password: "upstream-s3cret"}
+	wrongCred := auth.Credentials{Username: "upstream", Password: "wrong-s3cret"}
+	good := newAuthConnectProxy(t, upstreamCred)
+	refusing := newAuthConnectProxy(t, upstreamCred)
+
+	pool := proxy.NewPool(proxy.Options{Selector: &proxy.RoundRobinSelector{}})
+	pool.SetProxies([]proxy.Proxy{
+		{Protocol: "http", Address: good.Listener.Addr().String(), Credentials: &upstreamCred},
+		{Protocol: "http", Address: refusing.Listener.Addr().String(), Credentials: &wrongCred},
+	})
+	srv := httptest.NewServer(New(registryOf(pool), Options{
+		Verbose:     true,
+		Credentials: &clientCred,
+		AccessLog:   slog.New(slog.NewJSONHandler(redact.NewWriter(&logs), nil)),
+	}))
+	defer srv.Close()
+
+	// A tunnel through the good upstream, then one refused by the upstream
+	// holding the wrong password, then a client presenting a wrong password.
+	for _, cred := range []auth.Credentials{clientCred, clientCred, {Username: "client", Password: "guess-s3cret"}} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: %s\r\nAuthorization: %[2]s\r\n\r\n",
+			target.Listener.Addr().String(), cred.BasicHeader())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: target\r\n\r\n")
+			if tunneled, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+				tunneled.Body.Close()
+			}
+		}
+		conn.Close()
+	}
+
+	// Plain HTTP with credentials in the target URL.
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(clientCred.Username, clientCred.Password),
+		Host:   srv.Listener.Addr().String(),
+	})}}
+	resp, err := client.Get("http://target-user:target-s3cret@" + target.Listener.Addr().String() + "/")
+	if err == nil {
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	log.Printf("Configured upstream %+v and client %v", upstreamCred, &clientCred)
+
+	// Tunnels are logged when they close.
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(logs.String(), `"msg":"access"`) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "Headers:") || !strings.Contains(output, `"msg":"access"`) {
+		t.Fatalf("expected header dump and access records in logs:\n%s", output)
+	}
+	for _, cred := range []auth.Credentials{clientCred, upstreamCred, wrongCred, {Username: "client", Password: "guess-s3cret"}} {
+		header := cred.BasicHeader()
+		token := strings.TrimPrefix(header, "Basic ")
+		for _, secret := range []string{cred.Password, token} {
+			if strings.Contains(output, secret) {
+				t.Fatalf("log output contains secret %q:\n%s", secret, output)
+			}
+		}
+	}
+	if strings.Contains(output, "target-s3cret") {
+		t.Fatalf("log output contains target URL password:\n%s", output)
+	}
+}
+
+func TestProbesNeedNoCredentialsAndFollowDrain(t *testing.T) {
+	cred := auth.Credentials{Username: "alice", Password: "secret"}
+	srv := New(registryOf(proxy.NewPool(proxy.Options{})), Options{Credentials: &cred})
+
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Fatalf("expected /healthz 200, got %d", code)
+	}
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Fatalf("expected /readyz 200 before draining, got %d", code)
+	}
+
+	srv.Drain()
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /readyz 503 while draining, got %d", code)
+	}
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Fatalf("expected /healthz 200 while draining, got %d", code)
+	}
+}
+
+// startTunnelServer serves a proxy with opts on a random port whose single upstream
+// tunnels to an echo server, and returns the proxy, its address and the echo address.
+func startTunnelServer(t *testing.T, opts Options) (*Server, string, string) {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{newHalfCloseConnectProxy(t)})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	srv := New(registryOf(pool), opts)
+	go func() { _ = srv.Serve(listener) }()
+	return srv, listener.Addr().String(), echo.Addr().String()
+}
+
+// openTunnel issues CONNECT through the proxy and checks that the tunnel echoes.
+func openTunnel(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel to open, got %d", resp.StatusCode)
+	}
+	assertEcho(t, conn, reader, "ping")
+	return conn, reader
+}
+
+func assertEcho(t *testing.T, conn net.Conn, reader *bufio.Reader, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write through tunnel: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != msg {
+		t.Fatalf("expected echo %q, got %q (%v)", msg, got, err)
+	}
+}
+
+func TestShutdownWaitsForOpenTunnels(t *testing.T) {
+	srv, proxyAddr, target := startTunnelServer(t, Options{})
+	conn, reader := openTunnel(t, proxyAddr, target)
+
+	done := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		probe, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			break
+		}
+		probe.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("expected listener to close after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assertEcho(t, conn, reader, "still open")
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while a tunnel was open", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown once the tunnel closed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Shutdown did not return after the last tunnel closed")
+	}
+}
+
+func TestShutdownClosesTunnelsAfterDrainTimeout(t *testing.T) {
+	srv, proxyAddr, target := startTunnelServer(t, Options{})
+	_, reader := openTunnel(t, proxyAddr, target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected drain timeout, got %v", err)
+	}
+	if n := srv.TunnelCount(); n != 0 {
+		t.Fatalf("expected every tunnel to be closed, %d still open", n)
+	}
+
+	var netErr net.Error
+	if _, err := reader.ReadByte(); err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("expected client side of the tunnel to be closed, got %v", err)
+	}
+}
+
+func TestShutdownWaitsForTunnelsStillDialing(t *testing.T) {
+	srv, proxyAddr, target := startTunnelServer(t, Options{})
+	pool, err := srv.pools.Get("")
+	if err != nil {
+		t.Fatalf("default pool: %v", err)
+	}
+	gate := make(chan struct{})
+	pool.SetProxies([]proxy.Proxy{gatedProxy(t, newHalfCloseConnectProxy(t), gate)})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the CONNECT to be dialing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while a CONNECT was dialing", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(gate)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel dialed during Shutdown to open, got %d", resp.StatusCode)
+	}
+	assertEcho(t, conn, reader, "dialed late")
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while a tunnel was open", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown once the tunnel closed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Shutdown did not return after the last tunnel closed")
+	}
+}
+
+func TestShutdownFailsReadinessBeforeDraining(t *testing.T) {
+	srv, proxyAddr, target := startTunnelServer(t, Options{ShutdownDelay: 300 * time.Millisecond})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get("http://" + proxyAddr + "/readyz")
+		if err != nil {
+			t.Fatalf("expected the listener to serve during the shutdown delay: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected /readyz 503 once Shutdown started, got %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _ := openTunnel(t, proxyAddr, target)
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Shutdown did not return after the delay")
+	}
+}
+
+// gatedProxy relays connections and half-closes to upstream only once gate is closed, like a slow upstream dial.
+func gatedProxy(t *testing.T, upstream proxy.Proxy, gate <-chan struct{}) proxy.Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				<-gate
+				next, err := net.Dial("tcp", upstream.Address)
+				if err != nil {
+					return
+				}
+				defer next.Close()
+				go func() {
+					_, _ = io.Copy(next, conn)
+					_ = next.(*net.TCPConn).CloseWrite()
+				}()
+				_, _ = io.Copy(conn, next)
+			}()
+		}
+	}()
+	return proxy.Proxy{Protocol: "http", Address: listener.Addr().String()}
+}
+
+// silentProxy accepts connections and never answers, like a black-holed upstream.
+func silentProxy(t *testing.T) proxy.Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	accepted := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		_ = listener.Close()
+		close(accepted)
+		for conn := range accepted {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case accepted <- conn:
+			default:
+				_ = conn.Close()
+			}
+		}
+	}()
+	return proxy.Proxy{Protocol: "http", Address: listener.Addr().String()}
+}
+
+// connectStatus sends CONNECT through the proxy at addr and returns the status and how long it took.
+func connectStatus(t *testing.T, addr string) (int, time.Duration) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	started := time.Now()
+	fmt.Fprintf(conn, "CONNECT target.invalid:443 HTTP/1.1\r\nHost: target.invalid:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(started)
+}
+
+func TestHandshakeTimeoutFailsOverFromSilentUpstream(t *testing.T) {
+	silent := silentProxy(t)
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{silent})
+
+	recorder := metrics.New()
+	srv := httptest.NewServer(New(registryOf(pool), Options{Metrics: recorder, HandshakeTimeout: 100 * time.Millisecond}))
+	defer srv.Close()
+
+	status, elapsed := connectStatus(t, srv.Listener.Addr().String())
+	if status != http.StatusBadGateway || elapsed > 3*time.Second {
+		t.Fatalf("expected a prompt 502, got %d after %s", status, elapsed)
+	}
+	if got := recorder.Failures.With("default", silent.Key()).Value(); got != maxRetries {
+		t.Fatalf("expected every attempt to count as an upstream failure, got %v", got)
+	}
+	if got := recorder.Requests.With(metrics.KindConnect, "default", "timeout").Value(); got != 1 {
+		t.Fatalf("expected the request to be recorded as a timeout, got %v", got)
+	}
+}
+
+func TestUpstreamIsBusyWhileDialing(t *testing.T) {
+	silent := silentProxy(t)
+	silent.MaxConns = 1
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{silent})
+
+	srv := httptest.NewServer(New(registryOf(pool), Options{HandshakeTimeout: 300 * time.Millisecond}))
+	defer srv.Close()
+
+	done := make(chan int, 1)
+	go func() {
+		status, _ := connectStatus(t, srv.Listener.Addr().String())
+		done <- status
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Stats()[0].ActiveConns != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upstream to count as active while the tunnel is dialing")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pool.Available(silent) {
+		t.Fatalf("expected an upstream at max_conns to be unavailable while dialing")
+	}
+
+	if status := <-done; status != http.StatusBadGateway {
+		t.Fatalf("expected 502 from the silent upstream, got %d", status)
+	}
+	if got := pool.Stats()[0].ActiveConns; got != 0 {
+		t.Fatalf("expected failed dials to release the upstream, got %d active", got)
+	}
+}
+
+func TestRequestTimeoutStopsRetries(t *testing.T) {
+	silent := silentProxy(t)
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{silent})
+
+	recorder := metrics.New()
+	srv := httptest.NewServer(New(registryOf(pool), Options{Metrics: recorder, RequestTimeout: 150 * time.Millisecond}))
+	defer srv.Close()
+
+	status, elapsed := connectStatus(t, srv.Listener.Addr().String())
+	if status != http.StatusBadGateway || elapsed > 3*time.Second {
+		t.Fatalf("expected a prompt 502, got %d after %s", status, elapsed)
+	}
+	if got := recorder.Failures.With("default", silent.Key()).Value(); got != 0 {
+		t.Fatalf("expected the request timeout not to be blamed on the upstream, got %v failures", got)
+	}
+
+	plain := httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil)
+	rec := httptest.NewRecorder()
+	started := time.Now()
+	srv.Config.Handler.ServeHTTP(rec, plain)
+	if rec.Code < http.StatusInternalServerError || time.Since(started) > 3*time.Second {
+		t.Fatalf("expected a prompt 5xx for plain HTTP, got %d after %s", rec.Code, time.Since(started))
+	}
+}
+
+func TestIdleTunnelIsClosed(t *testing.T) {
+	srv, proxyAddr, target := startTunnelServer(t, Options{IdleTimeout: 150 * time.Millisecond})
+	conn, reader := openTunnel(t, proxyAddr, target)
+
+	// Traffic keeps the tunnel open well past the idle timeout.
+	for i := 0; i < 5; i++ {
+		time.Sleep(60 * time.Millisecond)
+		assertEcho(t, conn, reader, "keepalive")
+	}
+
+	var netErr net.Error
+	if _, err := reader.ReadByte(); err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("expected the idle tunnel to be closed, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.TunnelCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.TunnelCount(); n != 0 {
+		t.Fatalf("expected the idle tunnel to be released, %d still open", n)
+	}
+}
+
+func TestSlowOriginDoesNotFailUpstream(t *testing.T) {
+	// The forwarding upstream is healthy; only the origin behind it is slow.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("late"))
+	}))
+	defer slow.Close()
+	upstream := proxy.Proxy{Protocol: "http", Address: slow.Listener.Addr().String()}
+
+	tests := []struct {
+		name       string
+		opts       Options
+		wantStatus int
+	}{
+		{"handshake timeout does not cover the origin", Options{HandshakeTimeout: 100 * time.Millisecond}, http.StatusOK},
+		{"response timeout is blamed on the target", Options{ResponseTimeout: 100 * time.Millisecond}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := proxy.NewPool(proxy.Options{Breaker: proxy.BreakerOptions{FailureThreshold: 1}})
+			pool.SetProxies([]proxy.Proxy{upstream})
+			recorder := metrics.New()
+			tt.opts.Metrics = recorder
+			srv := New(registryOf(pool), tt.opts)
+
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://target.invalid/", nil))
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+				}
+			}
+
+			if got := recorder.Failures.With("default", upstream.Key()).Value(); got != 0 {
+				t.Fatalf("expected no upstream failures, got %v", got)
+			}
+			if got := recorder.Retries.With(metrics.KindHTTP, "default").Value(); got != 0 {
+				t.Fatalf("expected no retries, got %v", got)
+			}
+			if !pool.Available(upstream) {
+				t.Fatalf("expected the upstream to stay available")
+			}
+		})
+	}
+}
+
+// newHalfCloseConnectProxy is a CONNECT proxy that forwards half-closes in both directions.
+func newHalfCloseConnectProxy(t *testing.T) proxy.Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+				done := make(chan struct{})
+				go func() {
+					_, _ = io.Copy(target, reader)
+					_ = target.(*net.TCPConn).CloseWrite()
+					close(done)
+				}()
+				_, _ = io.Copy(conn, target)
+				_ = conn.(*net.TCPConn).CloseWrite()
+				<-done
+			}()
+		}
+	}()
+	return proxy.Proxy{Protocol: "http", Address: listener.Addr().String()}
+}
+
+func TestTunnelForwardsHalfClose(t *testing.T) {
+	// The target answers only after the client has finished sending.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen target: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write([]byte("got:" + string(request)))
+	}()
+
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{newHalfCloseConnectProxy(t)})
+	srv := httptest.NewServer(New(registryOf(pool), Options{}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target.Addr().String())
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tunnel to open, got %v, %v", resp, err)
+	}
+
+	_, _ = conn.Write([]byte("hello"))
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("half-close: %v", err)
+	}
+	reply, err := io.ReadAll(reader)
+	if err != nil || string(reply) != "got:hello" {
+		t.Fatalf("expected %q after half-close, got %q (%v)", "got:hello", reply, err)
+	}
+}
+
+func TestTransportCacheFollowsPoolChanges(t *testing.T) {
+	plain := proxy.Proxy{Protocol: "https", Address: "127.0.0.1:8443"}
+	insecure := proxy.Proxy{Protocol: "https", Address: "127.0.0.1:8443", TLS: &proxy.TLSOptions{InsecureSkipVerify: true}}
+	pool := proxy.NewPool(proxy.Options{})
+	pool.SetProxies([]proxy.Proxy{plain, insecure})
+	srv := New(registryOf(pool), Options{})
+
+	first, err := srv.transportFor(plain)
+	if err != nil {
+		t.Fatalf("transportFor: %v", err)
+	}
+	again, _ := srv.transportFor(plain)
+	if again != first {
+		t.Fatalf("expected the transport to be reused for the same upstream")
+	}
+	other, err := srv.transportFor(insecure)
+	if err != nil {
+		t.Fatalf("transportFor: %v", err)
+	}
+	if other == first {
+		t.Fatalf("expected a separate transport for different TLS options")
+	}
+
+	pool.SetProxies([]proxy.Proxy{insecure})
+	if _, ok := srv.transports.Load(mustTransportKey(t, plain)); ok {
+		t.Fatalf("expected the transport of the removed upstream to be evicted")
+	}
+	if cached, ok := srv.transports.Load(mustTransportKey(t, insecure)); !ok || cached != other {
+		t.Fatalf("expected the transport of the remaining upstream to be kept")
+	}
+
+	if !pool.Remove(insecure.Key()) {
+		t.Fatalf("expected %s to be removed", insecure.Key())
+	}
+	if _, ok := srv.transports.Load(mustTransportKey(t, insecure)); ok {
+		t.Fatalf("expected the transport to be evicted after Remove")
+	}
+}
+
+func mustTransportKey(t *testing.T, upstream proxy.Proxy) transportKey {
+	t.Helper()
+	key, err := transportKeyFor(upstream)
+	if err != nil {
+		t.Fatalf("transportKeyFor: %v", err)
+	}
+	return key
+}
@@ -0,0 +1,196 @@
+// Package socks4 implements a client for SOCKS4 and SOCKS4a proxy servers.
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	version        = 0x04
+	commandConnect = 0x01
+	replyVersion   = 0x00
+
+	replyGranted       = 90
+	replyRejected      = 91
+	replyNoIdentd      = 92
+	replyIdentMismatch = 93
+
+	replyLength = 8
+)
+
+// ErrUnsupportedAddress is returned when the target cannot be expressed in a SOCKS4 request.
+var ErrUnsupportedAddress = errors.New("socks4: only IPv4 targets are supported")
+
+// ReplyError is returned when the SOCKS4 server does not grant the request.
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	switch e.Code {
+	case replyRejected:
+		return "socks4: request rejected or failed"
+	case replyNoIdentd:
+		return "socks4: request rejected, server cannot reach identd on the client"
+	case replyIdentMismatch:
+		return "socks4: request rejected, user id mismatch"
+	default:
+		return fmt.Sprintf("socks4: unknown reply code %d", e.Code)
+	}
+}
+
+// IdentRejected reports whether the server refused the supplied user id.
+func (e *ReplyError) IdentRejected() bool {
+	return e.Code == replyNoIdentd || e.Code == replyIdentMismatch
+}
+
+// Dialer connects to targets through a SOCKS4 or SOCKS4a server.
+type Dialer struct {
+	// ProxyAddress is the host:port of the SOCKS server.
+	ProxyAddress string
+	// UserID is sent in the USERID field of the request.
+	UserID string
+	// RemoteDNS enables SOCKS4a, letting the server resolve hostnames.
+	RemoteDNS bool
+	// Forward dials the SOCKS server. Defaults to a plain net.Dialer.
+	Forward func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Resolver resolves hostnames when RemoteDNS is disabled. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Dial connects to addr through the SOCKS server.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the SOCKS server, honoring ctx during the handshake.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("socks4: network %q is not supported", network)
+	}
+
+	request, err := d.buildRequest(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.forward(ctx, d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshake(ctx, conn, request); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) forward(ctx context.Context, addr string) (net.Conn, error) {
+	if d.Forward != nil {
+		return d.Forward(ctx, "tcp", addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (d *Dialer) buildRequest(ctx context.Context, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: invalid target address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("socks4: invalid target port %q", portStr)
+	}
+
+	request := []byte{version, commandConnect, byte(port >> 8), byte(port)}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, ErrUnsupportedAddress
+		}
+		request = append(request, ip4...)
+		request = append(request, d.UserID...)
+		request = append(request, 0)
+	case d.RemoteDNS:
+		// SOCKS4a: 0.0.0.x signals that the hostname follows the user id.
+		request = append(request, 0, 0, 0, 1)
+		request = append(request, d.UserID...)
+		request = append(request, 0)
+		request = append(request, host...)
+		request = append(request, 0)
+	default:
+		ip4, err := d.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		request = append(request, ip4...)
+		request = append(request, d.UserID...)
+		request = append(request, 0)
+	}
+
+	return request, nil
+}
+
+func (d *Dialer) resolve(ctx context.Context, host string) (net.IP, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: resolve %s: %w", host, err)
+	}
+	for _, candidate := range addrs {
+		if ip4 := candidate.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, ErrUnsupportedAddress
+}
+
+func handshake(ctx context.Context, conn net.Conn, request []byte) (err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// Cancelling ctx unblocks the exchange by moving the deadline into the past.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("socks4: write request: %w", err)
+	}
+
+	reply := make([]byte, replyLength)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks4: read reply: %w", err)
+	}
+
+	if reply[0] != replyVersion {
+		return fmt.Errorf("socks4: unexpected reply version %d", reply[0])
+	}
+	if reply[1] != replyGranted {
+		return &ReplyError{Code: reply[1]}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package socks4
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type socksRequest struct {
+	port   uint16
+	ip     net.IP
+	userID string
+	host   string
+}
+
+// startFakeServer runs a SOCKS4/4a server that replies with code and echoes data once granted.
+func startFakeServer(t *testing.T, code byte) (string, <-chan socksRequest) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	requests := make(chan socksRequest, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		req := socksRequest{
+			port: uint16(header[2])<<8 | uint16(header[3]),
+			ip:   net.IP(header[4:8]),
+		}
+		userID, err := reader.ReadString(0)
+		if err != nil {
+			return
+		}
+		req.userID = userID[:len(userID)-1]
+		if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+			host, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			req.host = host[:len(host)-1]
+		}
+		requests <- req
+
+		_, _ = conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		if code == replyGranted {
+			_, _ = io.Copy(conn, reader)
+		}
+	}()
+
+	return listener.Addr().String(), requests
+}
+
+func TestDialSOCKS4WithIPTarget(t *testing.T) {
+	addr, requests := startFakeServer(t, replyGranted)
+
+	dialer := &Dialer{ProxyAddress: addr, UserID: "alice"}
+	conn, err := dialer.Dial("tcp", "192.0.2.10:8443")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if !req.ip.Equal(net.ParseIP("192.0.2.10")) || req.port != 8443 {
+		t.Fatalf("unexpected target %s:%d", req.ip, req.port)
+	}
+	if req.userID != "alice" {
+		t.Fatalf("expected user id alice, got %q", req.userID)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo through tunnel, got %q (%v)", buf, err)
+	}
+}
+
+func TestDialSOCKS4aSendsHostname(t *testing.T) {
+	addr, requests := startFakeServer(t, replyGranted)
+
+	dialer := &Dialer{ProxyAddress: addr, RemoteDNS: true}
+	conn, err := dialer.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.host != "example.com" || req.port != 443 {
+		t.Fatalf("expected remote hostname example.com:443, got %q:%d", req.host, req.port)
+	}
+	if req.userID != "" {
+		t.Fatalf("expected empty user id, got %q", req.userID)
+	}
+}
+
+func TestDialSOCKS4ResolvesLocally(t *testing.T) {
+	addr, requests := startFakeServer(t, replyGranted)
+
+	dialer := &Dialer{ProxyAddress: addr}
+	conn, err := dialer.Dial("tcp", "localhost:80")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.host != "" {
+		t.Fatalf("expected no remote hostname for SOCKS4, got %q", req.host)
+	}
+	if !req.ip.IsLoopback() {
+		t.Fatalf("expected locally resolved loopback address, got %s", req.ip)
+	}
+}
+
+func TestDialSOCKS4ReportsRejection(t *testing.T) {
+	addr, _ := startFakeServer(t, replyIdentMismatch)
+
+	dialer := &Dialer{ProxyAddress: addr, UserID: "mallory"}
+	_, err := dialer.Dial("tcp", "192.0.2.10:80")
+
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("expected ReplyError, got %v", err)
+	}
+	if !replyErr.IdentRejected() {
+		t.Fatalf("expected ident rejection, got code %d", replyErr.Code)
+	}
+}
+
+func TestDialSOCKS4RejectsIPv6Target(t *testing.T) {
+	dialer := &Dialer{ProxyAddress: "127.0.0.1:1"}
+	if _, err := dialer.Dial("tcp", "[2001:db8::1]:80"); !errors.Is(err, ErrUnsupportedAddress) {
+		t.Fatalf("expected ErrUnsupportedAddress, got %v", err)
+	}
+}
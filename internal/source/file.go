@@ -0,0 +1,60 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+)
+
+// File loads a proxy list from disk, detecting changes by modification time and size.
+type File struct {
+	Path               string
+	DefaultCredentials *auth.Credentials
+	// Format of the list; FormatAuto detects it from the file extension.
+	Format proxy.Format
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	loaded  bool
+}
+
+// Load implements Source.
+func (f *File) Load(_ context.Context) ([]proxy.Proxy, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("stat proxy list: %w", err)
+	}
+
+	f.mu.Lock()
+	unchanged := f.loaded && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.Unlock()
+	if unchanged {
+		return nil, ErrNotModified
+	}
+
+	// Remember the version even when it fails to parse, so a bad file is reported once.
+	f.mu.Lock()
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.loaded = true
+	f.mu.Unlock()
+
+	return proxy.ParseFileAs(f.Path, f.Format, f.DefaultCredentials)
+}
+
+// Reset implements Source.
+func (f *File) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loaded = false
+}
+
+func (f *File) String() string {
+	return f.Path
+}
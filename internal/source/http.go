@@ -0,0 +1,167 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proxygate/internal/auth"
+	"proxygate/internal/proxy"
+	"proxygate/internal/redact"
+)
+
+const (
+	defaultHTTPTimeout = 30 * time.Second
+	maxListSize        = 16 << 20
+)
+
+// HTTP fetches a proxy list from an http(s):// URL using conditional requests.
+// When CachePath is set, every good list is written there and used as a
+// fallback if the endpoint is unreachable on the first load.
+type HTTP struct {
+	URL                string
+	DefaultCredentials *auth.Credentials
+	// Format of the list; FormatAuto detects it from the URL path extension.
+	Format    proxy.Format
+	Timeout   time.Duration
+	CachePath string
+	// Client overrides the HTTP client; Timeout still bounds each fetch.
+	Client *http.Client
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	loaded       bool
+}
+
+func (h *HTTP) format() proxy.Format {
+	if h.Format != proxy.FormatAuto {
+		return h.Format
+	}
+	return proxy.DetectFormat(h.URL)
+}
+
+// IsURL reports whether location names an HTTP(S) list rather than a file.
+func IsURL(location string) bool {
+	lower := strings.ToLower(location)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// Load implements Source.
+func (h *HTTP) Load(ctx context.Context) ([]proxy.Proxy, error) {
+	proxies, err := h.fetch(ctx)
+	if err == nil || err == ErrNotModified {
+		return proxies, err
+	}
+
+	h.mu.Lock()
+	loaded := h.loaded
+	h.mu.Unlock()
+	if loaded || h.CachePath == "" {
+		return nil, err
+	}
+
+	cached, cacheErr := proxy.ParseFileAs(h.CachePath, h.format(), h.DefaultCredentials)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%w (cache fallback failed: %v)", err, cacheErr)
+	}
+	log.Printf("Fetching %s failed, using last good list from %s: %v", h, h.CachePath, err)
+	return cached, nil
+}
+
+func (h *HTTP) fetch(ctx context.Context) ([]proxy.Proxy, error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build proxy list request: %w", err)
+	}
+
+	h.mu.Lock()
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.lastModified != "" {
+		req.Header.Set("If-Modified-Since", h.lastModified)
+	}
+	h.mu.Unlock()
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch proxy list: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, ErrNotModified
+	default:
+		return nil, fmt.Errorf("fetch proxy list: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read proxy list: %w", err)
+	}
+	if len(body) > maxListSize {
+		return nil, fmt.Errorf("proxy list exceeds %d bytes", maxListSize)
+	}
+
+	proxies, err := proxy.ParseAs(bytes.NewReader(body), h.format(), h.DefaultCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	h.etag = resp.Header.Get("ETag")
+	h.lastModified = resp.Header.Get("Last-Modified")
+	h.loaded = true
+	h.mu.Unlock()
+
+	if h.CachePath != "" {
+		if err := writeCache(h.CachePath, body); err != nil {
+			log.Printf("Failed to cache proxy list to %s: %v", h.CachePath, err)
+		}
+	}
+
+	return proxies, nil
+}
+
+// Reset implements Source.
+func (h *HTTP) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.etag = ""
+	h.lastModified = ""
+}
+
+func (h *HTTP) String() string {
+	return redact.URL(h.URL)
+}
+
+// writeCache replaces the cache file atomically so readers never see a partial list.
+func writeCache(path string, body []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
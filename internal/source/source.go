@@ -0,0 +1,94 @@
+// Package source loads proxy lists and keeps pools up to date as they change.
+package source
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+// ErrNotModified is returned by Source.Load when the list is unchanged since the previous load.
+var ErrNotModified = errors.New("proxy list not modified")
+
+// Source produces the current proxy list.
+type Source interface {
+	// Load returns the proxies, or ErrNotModified when nothing changed since the last successful Load.
+	Load(ctx context.Context) ([]proxy.Proxy, error)
+	// Reset forgets change-detection state so the next Load always parses the list.
+	Reset()
+	String() string
+}
+
+// Reloader applies a Source to a Pool, periodically and on SIGHUP.
+type Reloader struct {
+	pool     *proxy.Pool
+	source   Source
+	interval time.Duration
+}
+
+// NewReloader returns a Reloader that polls source every interval; zero disables polling.
+func NewReloader(pool *proxy.Pool, source Source, interval time.Duration) *Reloader {
+	return &Reloader{pool: pool, source: source, interval: interval}
+}
+
+// Reload loads the source and swaps it into the pool. A failed load leaves the pool untouched.
+// When force is set, change detection is bypassed.
+func (r *Reloader) Reload(ctx context.Context, force bool) error {
+	if force {
+		r.source.Reset()
+	}
+
+	proxies, err := r.source.Load(ctx)
+	if errors.Is(err, ErrNotModified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.pool.SetProxies(proxies)
+	log.Printf("Loaded %d proxies from %s", len(proxies), r.source)
+	return nil
+}
+
+// Start reloads on every poll interval and SIGHUP until ctx is cancelled. SIGHUP
+// is subscribed to before Start returns, so a signal sent right after startup
+// reloads the list instead of terminating the process.
+func (r *Reloader) Start(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go r.run(ctx, hangup)
+}
+
+func (r *Reloader) run(ctx context.Context, hangup chan os.Signal) {
+	defer signal.Stop(hangup)
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Printf("SIGHUP received, reloading %s", r.source)
+			if err := r.Reload(ctx, true); err != nil {
+				log.Printf("Reload of %s rejected, keeping current proxies: %v", r.source, err)
+			}
+		case <-tick:
+			if err := r.Reload(ctx, false); err != nil {
+				log.Printf("Reload of %s rejected, keeping current proxies: %v", r.source, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"proxygate/internal/proxy"
+)
+
+func writeList(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write proxy list: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("set mod time: %v", err)
+	}
+}
+
+func TestReloaderSwapsFileContents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	modTime := time.Unix(1_700_000_000, 0)
+	writeList(t, path, "10.0.0.1:8080\n10.0.0.2:8080\n", modTime)
+
+	pool := proxy.NewPool(proxy.Options{})
+	reloader := NewReloader(pool, &File{Path: path}, 0)
+	ctx := context.Background()
+
+	if err := reloader.Reload(ctx, true); err != nil {
+		t.Fatalf("initial Reload returned error: %v", err)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("expected 2 proxies, got %d", pool.Len())
+	}
+
+	kept := proxy.Proxy{Protocol: "http", Address: "10.0.0.1:8080"}
+	dropped := proxy.Proxy{Protocol: "http", Address: "10.0.0.2:8080"}
+	pool.BindSticky("keep", kept)
+	pool.BindSticky("drop", dropped)
+
+	writeList(t, path, "10.0.0.1:8080\n10.0.0.3:8080\n10.0.0.4:8080\n", modTime.Add(time.Second))
+	if err := reloader.Reload(ctx, false); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	if pool.Len() != 3 {
+		t.Fatalf("expected 3 proxies after reload, got %d", pool.Len())
+	}
+
+	if selected, _, err := pool.Select("keep", nil); err != nil || selected.Key() != kept.Key() {
+		t.Fatalf("expected sticky binding to surviving upstream to be kept, got %+v (%v)", selected, err)
+	}
+	if selected, _, err := pool.Select("drop", nil); err != nil || selected.Key() == dropped.Key() {
+		t.Fatalf("expected sticky binding to removed upstream to be dropped, got %+v (%v)", selected, err)
+	}
+
+	writeList(t, path, "ftp://\n", modTime.Add(2*time.Second))
+	if err := reloader.Reload(ctx, false); err == nil {
+		t.Fatalf("expected bad list to be rejected")
+	}
+	if pool.Len() != 3 {
+		t.Fatalf("expected running pool to be untouched by a bad list, got %d proxies", pool.Len())
+	}
+}
+
+func TestFileReportsNotModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	writeList(t, path, "10.0.0.1:8080\n", time.Unix(1_700_000_000, 0))
+
+	src := &File{Path: path}
+	if _, err := src.Load(context.Background()); err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if _, err := src.Load(context.Background()); err != ErrNotModified {
+		t.Fatalf("expected ErrNotModified, got %v", err)
+	}
+
+	src.Reset()
+	if _, err := src.Load(context.Background()); err != nil {
+		t.Fatalf("expected forced Load to parse again, got %v", err)
+	}
+}
+
+func TestHTTPSourceUsesConditionalRequests(t *testing.T) {
+	requests := 0
+	body := "10.0.0.1:8080\n10.0.0.2:8080\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	pool := proxy.NewPool(proxy.Options{})
+	reloader := NewReloader(pool, &HTTP{URL: server.URL, Timeout: time.Second}, 0)
+	ctx := context.Background()
+
+	if err := reloader.Reload(ctx, false); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("expected 2 proxies, got %d", pool.Len())
+	}
+
+	body = "10.0.0.9:8080\n"
+	if err := reloader.Reload(ctx, false); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	if pool.Len() != 2 {
+		t.Fatalf("expected 304 to leave pool untouched, got %d proxies", pool.Len())
+	}
+
+	if err := reloader.Reload(ctx, true); err != nil {
+		t.Fatalf("forced Reload returned error: %v", err)
+	}
+	if pool.Len() != 1 || requests != 3 {
+		t.Fatalf("expected forced reload to refetch, got %d proxies after %d requests", pool.Len(), requests)
+	}
+}
+
+func TestHTTPSourceKeepsLastGoodList(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("10.0.0.1:8080\n"))
+	}))
+	defer server.Close()
+
+	cachePath := filepath.Join(t.TempDir(), "cache.txt")
+	ctx := context.Background()
+
+	pool := proxy.NewPool(proxy.Options{})
+	reloader := NewReloader(pool, &HTTP{URL: server.URL, CachePath: cachePath}, 0)
+	if err := reloader.Reload(ctx, true); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+
+	healthy = false
+	if err := reloader.Reload(ctx, true); err == nil {
+		t.Fatalf("expected failed fetch to be reported")
+	}
+	if pool.Len() != 1 {
+		t.Fatalf("expected running pool to keep last good list, got %d proxies", pool.Len())
+	}
+
+	restarted := proxy.NewPool(proxy.Options{})
+	reloader = NewReloader(restarted, &HTTP{URL: server.URL, CachePath: cachePath}, 0)
+	if err := reloader.Reload(ctx, true); err != nil {
+		t.Fatalf("expected cache fallback on startup, got %v", err)
+	}
+	if restarted.Len() != 1 {
+		t.Fatalf("expected cached list to be loaded, got %d proxies", restarted.Len())
+	}
+}
+
+func TestHTTPSourceTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	src := &HTTP{URL: server.URL, Timeout: 50 * time.Millisecond}
+	if _, err := src.Load(context.Background()); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+}
+
+func TestReloaderReloadsOnSIGHUPRightAfterStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.txt")
+	modTime := time.Unix(1_700_000_000, 0)
+	writeList(t, path, "10.0.0.1:8080\n", modTime)
+
+	pool := proxy.NewPool(proxy.Options{})
+	reloader := NewReloader(pool, &File{Path: path}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := reloader.Reload(ctx, true); err != nil {
+		t.Fatalf("initial Reload returned error: %v", err)
+	}
+
+	// Polling is disabled, so only SIGHUP picks up the new list.
+	writeList(t, path, "10.0.0.1:8080\n10.0.0.2:8080\n", modTime)
+	reloader.Start(ctx)
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("find process: %v", err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Len() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected SIGHUP to reload the list, got %d proxies", pool.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}